@@ -0,0 +1,484 @@
+package main
+
+// An HTTP server with a JSON API, for managing sessions while we run.
+//
+//	GET    /api/torrents                  List the sessions
+//	POST   /api/torrents                  Add one. The body is a .torrent file, or
+//	                                      {"uri": "..."} for a URL, magnet or path.
+//	GET    /api/torrents/<hash>           One session
+//	DELETE /api/torrents/<hash>           Stop and forget it. The data stays.
+//	POST   /api/torrents/<hash>/pause
+//	POST   /api/torrents/<hash>/resume
+//	GET    /api/torrents/<hash>/peers
+//	GET    /api/torrents/<hash>/pieces
+//	GET    /api/torrents/<hash>/tracker
+//	GET    /api/torrents/<hash>/files
+//	PUT    /api/torrents/<hash>/files/<n> {"priority": 0 (skip) or 1}
+//	GET    /api/torrents/<hash>/limits
+//	PUT    /api/torrents/<hash>/limits    {"upload": n, "download": n} in bytes per second
+//	GET    /api/limits                    The global limits
+//	PUT    /api/limits
+//	GET    /api/log                       The log levels, as {"levels": "api=info,dht=info,..."}
+//	PUT    /api/log                       {"levels": "info,peer=debug"}, as for -logLevel
+//	GET    /metrics                       Prometheus metrics, see metrics.go
+//	GET    /api/events                    Server-sent events with the list of sessions
+//	                                      each second, see webui.go
+//
+// <hash> is the info hash in hex. Errors come back as {"error": "..."}.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var apiAddr string
+var apiToken string
+
+func init() {
+	flag.StringVar(&apiAddr, "apiAddr", "", "Serve the JSON control API on this address, e.g. localhost:8080. "+
+		"Empty means no API.")
+	flag.StringVar(&apiToken, "apiToken", "", "If set, API requests must send \"Authorization: Bearer <apiToken>\".")
+}
+
+// Largest .torrent file we accept through the API.
+const MAX_TORRENT_UPLOAD = 10 * 1024 * 1024
+
+type managedSession struct {
+	ts    *TorrentSession
+	id    int // Small and unique, for clients that don't use the info hash
+	added time.Time
+	done  chan bool // Closed once the session stopped
+	err   error     // Why it stopped
+}
+
+// inspect runs f on the session's main goroutine, or after the session
+// stopped if it isn't running.
+func (s *managedSession) inspect(f func()) {
+	if s.ts.do(f) != nil {
+		<-s.done
+		f()
+	}
+}
+
+func (s *managedSession) status() (st SessionStatus) {
+	s.inspect(func() { st = s.ts.status() })
+	select {
+	case <-s.done:
+		if s.err != nil {
+			st.Error = s.err.Error()
+		}
+	default:
+	}
+	return
+}
+
+// sessionManager runs any number of sessions at once.
+type sessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*managedSession // By info hash in hex
+	newStore StorageFactory
+	run      func(*TorrentSession) error // DoTorrent, but tests may differ
+	running  sync.WaitGroup
+	lastId   int
+
+	// 0 is no limit. The blob backend puts every torrent at the start of
+	// the same file, so it can only have one.
+	maxSessions int
+}
+
+var errDuplicateTorrent = errors.New("We already have this torrent.")
+var errTooManySessions = errors.New("The storage backend has no room for another torrent.")
+
+func newSessionManager(newStore StorageFactory) *sessionManager {
+	return &sessionManager{sessions: make(map[string]*managedSession), newStore: newStore,
+		run: (*TorrentSession).DoTorrent}
+}
+
+// Add opens a torrent from a file, URL or magnet link, and starts it. If
+// we already have the torrent, Add returns the running session and
+// errDuplicateTorrent.
+func (m *sessionManager) Add(torrent string) (ts *TorrentSession, err error) {
+	meta, err := getMetaInfo(torrent)
+	if err != nil {
+		return
+	}
+	// Opening a session checks its pieces, so don't for one we can't run.
+	m.mu.Lock()
+	s, ok := m.sessions[fmt.Sprintf("%x", meta.InfoHash)]
+	full := m.full()
+	m.mu.Unlock()
+	if ok {
+		return s.ts, errDuplicateTorrent
+	}
+	if full {
+		return nil, errTooManySessions
+	}
+	if ts, err = newTorrentSession(meta, m.newStore); err != nil {
+		return
+	}
+	if s, err = m.start(ts); err != nil {
+		// Someone added it, or another torrent, meanwhile.
+		ts.discard()
+		if s != nil {
+			return s.ts, err
+		}
+		return nil, err
+	}
+	return
+}
+
+func (m *sessionManager) full() bool {
+	return m.maxSessions > 0 && len(m.sessions) >= m.maxSessions
+}
+
+// start runs a new session. If we already have the torrent it returns the
+// session that has it, and errDuplicateTorrent.
+func (m *sessionManager) start(ts *TorrentSession) (s *managedSession, err error) {
+	hash := fmt.Sprintf("%x", ts.m.InfoHash)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[hash]; ok {
+		return s, errDuplicateTorrent
+	}
+	if m.full() {
+		return nil, errTooManySessions
+	}
+	m.lastId++
+	s = &managedSession{ts: ts, id: m.lastId, added: time.Now(), done: make(chan bool)}
+	m.sessions[hash] = s
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		s.err = m.run(ts)
+		if s.err != nil {
+			ts.logger(sessionLog).Error("Failed", "err", s.err)
+		} else {
+			ts.logger(sessionLog).Info("Done")
+		}
+		close(s.done)
+	}()
+	return
+}
+
+// Get returns the session with this info hash, or nil.
+func (m *sessionManager) Get(hash string) *managedSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[strings.ToLower(hash)]
+}
+
+func (m *sessionManager) List() (sessions []*managedSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Sort(byInfoHash(sessions))
+	return
+}
+
+type byInfoHash []*managedSession
+
+func (a byInfoHash) Len() int           { return len(a) }
+func (a byInfoHash) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byInfoHash) Less(i, j int) bool { return a[i].ts.m.InfoHash < a[j].ts.m.InfoHash }
+
+// Remove stops a session, waits for it to shut down, and forgets it.
+func (m *sessionManager) Remove(hash string) (err error) {
+	m.mu.Lock()
+	s, ok := m.sessions[strings.ToLower(hash)]
+	delete(m.sessions, strings.ToLower(hash))
+	m.mu.Unlock()
+	if !ok {
+		return errors.New("No such torrent.")
+	}
+	s.ts.Stop()
+	<-s.done
+	return
+}
+
+func (m *sessionManager) StopAll() {
+	for _, s := range m.List() {
+		s.ts.Stop()
+	}
+}
+
+// Wait returns once no session is running.
+func (m *sessionManager) Wait() {
+	m.running.Wait()
+}
+
+type rateLimits struct {
+	Upload   int `json:"upload"`
+	Download int `json:"download"`
+}
+
+type apiServer struct {
+	sessions *sessionManager
+	token    string
+}
+
+// serveAPI serves the API and the web UI on addr.
+func serveAPI(addr string, sessions *sessionManager) (err error) {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", &apiServer{sessions, apiToken})
+	mux.Handle("/transmission/rpc", newTransmissionServer(sessions, apiToken))
+	mux.Handle("/metrics", &metricsServer{sessions, apiToken})
+	mux.HandleFunc("/", serveWebUI)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	apiLog.Info("Serving the API", "addr", listener.Addr())
+	go func() {
+		apiLog.Error("API server failed", "err", http.Serve(listener, mux))
+	}()
+	return
+}
+
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func notFound(what string) error {
+	return &apiError{http.StatusNotFound, what + " not found."}
+}
+
+var errMethod = &apiError{http.StatusMethodNotAllowed, "Method not allowed."}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "Bad or missing API token."})
+		return
+	}
+	if r.URL.Path == "/api/events" {
+		a.events(w, r)
+		return
+	}
+	v, err := a.route(r, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/"))
+	if err != nil {
+		code := http.StatusBadRequest
+		if e, ok := err.(*apiError); ok {
+			code = e.code
+		}
+		writeJSON(w, code, map[string]string{"error": err.Error()})
+		return
+	}
+	if v == nil {
+		v = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (a *apiServer) authorized(r *http.Request) bool {
+	return hasToken(r, a.token)
+}
+
+// hasToken is whether a request carries the token, either as a bearer
+// token, as the basic auth password or as the token parameter. An empty token lets everyone in.
+func hasToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		given = password
+	} else if q := r.URL.Query().Get("token"); q != "" {
+		// Browsers can't set headers for an EventSource.
+		given = q
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		apiLog.Warn("Could not write API response", "err", err)
+	}
+}
+
+func (a *apiServer) route(r *http.Request, parts []string) (v interface{}, err error) {
+	switch {
+	case len(parts) == 1 && parts[0] == "limits":
+		return a.limits(r, globalUploadLimit, globalDownloadLimit)
+	case len(parts) == 1 && parts[0] == "log":
+		return a.logLevels(r)
+	case len(parts) == 1 && parts[0] == "torrents":
+		switch r.Method {
+		case "GET":
+			list := []SessionStatus{}
+			for _, s := range a.sessions.List() {
+				list = append(list, s.status())
+			}
+			return list, nil
+		case "POST":
+			return a.add(r)
+		}
+		return nil, errMethod
+	case len(parts) < 2 || parts[0] != "torrents":
+		return nil, notFound("Path")
+	}
+	s := a.sessions.Get(parts[1])
+	if s == nil {
+		return nil, notFound("Torrent")
+	}
+	ts := s.ts
+	if len(parts) == 2 {
+		switch r.Method {
+		case "GET":
+			return s.status(), nil
+		case "DELETE":
+			return nil, a.sessions.Remove(parts[1])
+		}
+		return nil, errMethod
+	}
+	if len(parts) == 4 && parts[2] == "files" {
+		if r.Method != "PUT" {
+			return nil, errMethod
+		}
+		i, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, notFound("File")
+		}
+		var body struct {
+			Priority int `json:"priority"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return nil, ts.SetFilePriority(i, body.Priority)
+	}
+	if len(parts) != 3 {
+		return nil, notFound("Path")
+	}
+	switch action := parts[2]; action {
+	case "pause", "resume":
+		if r.Method != "POST" {
+			return nil, errMethod
+		}
+		if action == "pause" {
+			return nil, ts.Pause()
+		}
+		return nil, ts.Resume()
+	case "limits":
+		return a.limits(r, ts.uploadLimit, ts.downloadLimit)
+	case "peers", "pieces", "tracker", "files":
+		if r.Method != "GET" {
+			return nil, errMethod
+		}
+		s.inspect(func() {
+			switch action {
+			case "peers":
+				v = ts.peerStatus()
+			case "pieces":
+				v = ts.pieceStatus()
+			case "tracker":
+				v = ts.trackerStatus()
+			case "files":
+				v = ts.fileStatus()
+			}
+		})
+		return
+	}
+	return nil, notFound("Path")
+}
+
+func (a *apiServer) limits(r *http.Request, up, down *tokenBucket) (v interface{}, err error) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var l rateLimits
+		if err = json.NewDecoder(r.Body).Decode(&l); err != nil {
+			return
+		}
+		if l.Upload < 0 || l.Download < 0 {
+			return nil, errors.New("Limits can't be negative.")
+		}
+		up.SetRate(l.Upload)
+		down.SetRate(l.Download)
+	default:
+		return nil, errMethod
+	}
+	return rateLimits{Upload: up.Rate(), Download: down.Rate()}, nil
+}
+
+type logSettings struct {
+	Levels string `json:"levels"`
+}
+
+func (a *apiServer) logLevels(r *http.Request) (v interface{}, err error) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var l logSettings
+		if err = json.NewDecoder(r.Body).Decode(&l); err != nil {
+			return
+		}
+		if err = setLogLevels(l.Levels); err != nil {
+			return
+		}
+		apiLog.Info("Changed the log levels", "levels", logLevels())
+	default:
+		return nil, errMethod
+	}
+	return logSettings{logLevels()}, nil
+}
+
+// add takes either a .torrent file, or JSON naming one.
+func (a *apiServer) add(r *http.Request) (v interface{}, err error) {
+	body := io.LimitReader(r.Body, MAX_TORRENT_UPLOAD)
+	var torrent string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			URI string `json:"uri"`
+		}
+		if err = json.NewDecoder(body).Decode(&req); err != nil {
+			return
+		}
+		if req.URI == "" {
+			return nil, errors.New("No uri given.")
+		}
+		torrent = req.URI
+	} else {
+		var f *os.File
+		if f, err = ioutil.TempFile("", "taipei-torrent"); err != nil {
+			return
+		}
+		defer os.Remove(f.Name())
+		_, err = io.Copy(f, body)
+		f.Close()
+		if err != nil {
+			return
+		}
+		torrent = f.Name()
+	}
+	ts, err := a.sessions.Add(torrent)
+	if err != nil {
+		return
+	}
+	s := a.sessions.Get(fmt.Sprintf("%x", ts.m.InfoHash))
+	if s == nil {
+		return nil, errors.New("Removed while being added.")
+	}
+	return s.status(), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serveControl stands in for DoTorrent: it only runs what the API asks for.
+func serveControl(ts *TorrentSession) error {
+	for {
+		select {
+		case f := <-ts.control:
+			f()
+		case <-ts.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// newControlledSession makes a session of 7 pieces, of which we have none,
+// for serveControl.
+func newControlledSession() (ts *TorrentSession) {
+	ts = &TorrentSession{m: &MetaInfo{InfoHash: "01234567890123456789",
+		Info: InfoDict{Name: "a", Length: 100, PieceLength: 16}},
+		si: &SessionInfo{Left: 100}, totalSize: 100, totalPieces: 7, lastPieceLength: 4,
+		pieceSet: NewBitset(7), peers: make(map[string]*peerState),
+		activePieces: make(map[int]*ActivePiece), control: make(chan func()),
+		uploadLimit: newTokenBucket(0), downloadLimit: newTokenBucket(0)}
+	ts.ctx, ts.cancel = context.WithCancel(context.Background())
+	return
+}
+
+func apiCall(t *testing.T, server *httptest.Server, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFileDir, oldTrackerLessMode := fileDir, trackerLessMode
+	fileDir, trackerLessMode = dir, true
+	defer func() { fileDir, trackerLessMode = oldFileDir, oldTrackerLessMode }()
+
+	sessions := newSessionManager(nil)
+	sessions.run = serveControl
+	server := httptest.NewServer(&apiServer{sessions, "secret"})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/torrents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %d without a token", resp.StatusCode)
+	}
+
+	if code := apiCall(t, server, "POST", "/api/torrents", `{"uri": "no/such.torrent"}`, nil); code != 400 {
+		t.Errorf("Adding a missing torrent gave %d", code)
+	}
+	ts := newControlledSession()
+	if _, err = sessions.start(ts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sessions.start(ts); err != errDuplicateTorrent {
+		t.Errorf("Started the same torrent twice")
+	}
+	sessions.maxSessions = 1
+	other := newControlledSession()
+	other.m.InfoHash = "abcdefghijabcdefghij"
+	if _, err = sessions.start(other); err != errTooManySessions {
+		t.Errorf("Started a second session with room for one: %v", err)
+	}
+	sessions.maxSessions = 0
+	var added SessionStatus
+	apiCall(t, server, "GET", "/api/torrents/3031323334353637383930313233343536373839", "", &added)
+	if added.State != "downloading" || added.Pieces != 7 {
+		t.Errorf("Added %+v", added)
+	}
+	hash := "/api/torrents/" + added.InfoHash
+
+	var list []SessionStatus
+	apiCall(t, server, "GET", "/api/torrents", "", &list)
+	if len(list) != 1 || list[0].InfoHash != added.InfoHash {
+		t.Errorf("Listed %+v", list)
+	}
+
+	var status SessionStatus
+	apiCall(t, server, "POST", hash+"/pause", "", nil)
+	apiCall(t, server, "GET", hash, "", &status)
+	if status.State != "paused" {
+		t.Errorf("State %s after pausing", status.State)
+	}
+	apiCall(t, server, "POST", hash+"/resume", "", nil)
+	apiCall(t, server, "GET", hash, "", &status)
+	if status.State != "downloading" {
+		t.Errorf("State %s after resuming", status.State)
+	}
+
+	var limits rateLimits
+	apiCall(t, server, "PUT", hash+"/limits", `{"upload": 1000, "download": 2000}`, &limits)
+	if limits.Upload != 1000 || limits.Download != 2000 {
+		t.Errorf("Limits %+v", limits)
+	}
+
+	var levels logSettings
+	apiCall(t, server, "PUT", "/api/log", `{"levels": "info,picker=debug"}`, &levels)
+	if !strings.Contains(levels.Levels, "picker=debug") || !strings.Contains(levels.Levels, "peer=info") {
+		t.Errorf("Log levels %+v", levels)
+	}
+	if code := apiCall(t, server, "PUT", "/api/log", `{"levels": "loud"}`, nil); code != 400 {
+		t.Errorf("Setting a bad log level gave %d", code)
+	}
+	setLogLevels("info")
+
+	var files []FileStatus
+	if code := apiCall(t, server, "PUT", hash+"/files/0", `{"priority": 0}`, nil); code != 200 {
+		t.Errorf("Setting a priority gave %d", code)
+	}
+	apiCall(t, server, "GET", hash+"/files", "", &files)
+	if len(files) == 0 || files[0].Priority != PRIORITY_SKIP {
+		t.Errorf("Files %+v", files)
+	}
+	if code := apiCall(t, server, "PUT", hash+"/files/99", `{"priority": 0}`, nil); code != 400 {
+		t.Errorf("Setting the priority of a missing file gave %d", code)
+	}
+
+	var pieces PieceStatus
+	apiCall(t, server, "GET", hash+"/pieces", "", &pieces)
+	if pieces.Pieces != added.Pieces || len(pieces.Bitfield) != (pieces.Pieces+7)/8 {
+		t.Errorf("Pieces %+v", pieces)
+	}
+	var peers []PeerStatus
+	if code := apiCall(t, server, "GET", hash+"/peers", "", &peers); code != 200 || len(peers) != 0 {
+		t.Errorf("Peers %d %+v", code, peers)
+	}
+
+	if code := apiCall(t, server, "DELETE", hash, "", nil); code != 200 {
+		t.Errorf("Remove gave %d", code)
+	}
+	if code := apiCall(t, server, "GET", hash, "", nil); code != 404 {
+		t.Errorf("Removed torrent gave %d", code)
+	}
+	sessions.Wait()
+}
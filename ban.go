@@ -0,0 +1,180 @@
+package main
+
+// Finding peers that send bad data. We remember who sent each block of a
+// piece. When a piece fails its hash check and more than one peer sent it,
+// it is downloaded again from a single peer, one that wasn't involved if we
+// can. Comparing the two downloads block by block then shows who sent the
+// bad blocks. Each time a peer is caught it gets a strike, and after
+// BAN_STRIKES strikes its address is banned.
+
+import (
+	"crypto/sha1"
+	"net"
+)
+
+const BAN_STRIKES = 3
+
+// A piece that failed its hash check, and who we got it from.
+type badPiece struct {
+	sources []string // Address of the peer that sent each block
+	hashes  [][]byte // SHA1 of each block we got, nil if the data was flushed early
+}
+
+// peerHost is the part of a peer address that strikes and bans apply to.
+// Peers come back on a different port.
+func peerHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func (t *TorrentSession) isBanned(address string) bool {
+	return t.banned[peerHost(address)]
+}
+
+// mayConnect is whether we may talk to a peer at all.
+func (t *TorrentSession) mayConnect(address string) bool {
+	return !t.isBanned(address) && !isBlocked(address)
+}
+
+// strike records that a peer sent bad data, and bans it once it has done so
+// too often.
+func (t *TorrentSession) strike(address string) {
+	host := peerHost(address)
+	t.strikes[host]++
+	t.logger(peerLog).Warn("Peer sent bad data", "peer", address, "strikes", t.strikes[host])
+	if t.strikes[host] < BAN_STRIKES || t.banned[host] {
+		return
+	}
+	t.logger(peerLog).Warn("Banning", "host", host)
+	t.banned[host] = true
+	for _, p := range t.peers {
+		if peerHost(p.address) == host {
+			t.ClosePeer(p)
+		}
+	}
+}
+
+// distinctSources lists the peers that sent blocks of a piece.
+func distinctSources(sources []string) (peers []string) {
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		if s != "" && !seen[s] {
+			seen[s] = true
+			peers = append(peers, s)
+		}
+	}
+	return
+}
+
+func blockHashes(data []byte) (hashes [][]byte) {
+	for begin := 0; begin < len(data); begin += STANDARD_BLOCK_LENGTH {
+		end := begin + STANDARD_BLOCK_LENGTH
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[begin:end])
+		hashes = append(hashes, h[:])
+	}
+	return
+}
+
+// pieceFailed is called when a piece fails its hash check. data is the
+// whole piece, or nil if it was flushed to disk early.
+func (t *TorrentSession) pieceFailed(v *ActivePiece, data []byte) {
+	t.metrics.count(&t.metrics.hashFailures, 1)
+	suspects := distinctSources(v.sources)
+	t.logger(storageLog).Warn("Piece failed its hash check", "piece", v.index, "sources", suspects)
+	if len(suspects) == 1 {
+		// No doubt about who it was.
+		delete(t.badPieces, v.index)
+		t.strike(suspects[0])
+		return
+	}
+	bad := &badPiece{sources: v.sources}
+	if data != nil {
+		bad.hashes = blockHashes(data)
+	}
+	t.badPieces[v.index] = bad
+}
+
+// pieceSucceeded is called when a piece passes its hash check. If an earlier
+// download of it failed, the blocks that changed tell us who sent bad data.
+func (t *TorrentSession) pieceSucceeded(v *ActivePiece, data []byte) {
+	bad, ok := t.badPieces[v.index]
+	if !ok {
+		return
+	}
+	delete(t.badPieces, v.index)
+	var culprits []string
+	if bad.hashes != nil && data != nil {
+		var sources []string
+		for i, h := range blockHashes(data) {
+			if i < len(bad.hashes) && !checkEqual(string(bad.hashes[i]), h) {
+				sources = append(sources, bad.sources[i])
+			}
+		}
+		culprits = distinctSources(sources)
+	} else {
+		// Without the data, all we know is that the peers who sent the
+		// good copy are innocent.
+		innocent := make(map[string]bool)
+		for _, s := range v.sources {
+			innocent[s] = true
+		}
+		for _, s := range distinctSources(bad.sources) {
+			if !innocent[s] {
+				culprits = append(culprits, s)
+			}
+		}
+		if len(culprits) != 1 {
+			t.logger(peerLog).Info("Can't tell who sent bad data", "piece", v.index, "suspects", culprits)
+			return
+		}
+	}
+	for _, c := range culprits {
+		t.strike(c)
+	}
+}
+
+// mayDownload is whether p may request blocks of an active piece. Pieces
+// downloaded again after a failure come from one peer only.
+func (t *TorrentSession) mayDownload(p *peerState, v *ActivePiece) bool {
+	return v.pinned == "" || v.pinned == p.address
+}
+
+// mayRetry is whether p should be the one to download a piece again after it
+// failed. Peers that sent part of the bad copy only get to when nobody
+// else has the piece.
+func (t *TorrentSession) mayRetry(p *peerState, piece int) bool {
+	bad, ok := t.badPieces[piece]
+	if !ok || !bad.suspect(p.address) {
+		return true
+	}
+	for _, other := range t.peers {
+		if other.have != nil && other.have.IsSet(piece) && !bad.suspect(other.address) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bad *badPiece) suspect(address string) bool {
+	for _, s := range bad.sources {
+		if s == address {
+			return true
+		}
+	}
+	return false
+}
+
+// unpinPieces lets other peers finish the pieces p was downloading alone,
+// once p chokes us or goes away.
+func (t *TorrentSession) unpinPieces(p *peerState) {
+	for _, v := range t.activePieces {
+		if v.pinned == p.address {
+			v.pinned = ""
+		}
+	}
+}
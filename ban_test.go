@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newBanTestSession() *TorrentSession {
+	return &TorrentSession{peers: make(map[string]*peerState),
+		activePieces: make(map[int]*ActivePiece),
+		badPieces:    make(map[int]*badPiece),
+		strikes:      make(map[string]int),
+		banned:       make(map[string]bool)}
+}
+
+func TestBadPieceAttribution(t *testing.T) {
+	ts := newBanTestSession()
+	good := bytes.Repeat([]byte{1}, 2*STANDARD_BLOCK_LENGTH)
+	bad := append([]byte(nil), good...)
+	bad[STANDARD_BLOCK_LENGTH] = 2
+
+	// Two peers sent the bad copy. We can't tell which yet.
+	ts.pieceFailed(&ActivePiece{index: 7, sources: []string{"1.1.1.1:1", "2.2.2.2:2"}}, bad)
+	if len(ts.strikes) != 0 {
+		t.Fatalf("Struck a peer without knowing who was to blame: %v", ts.strikes)
+	}
+	if _, ok := ts.badPieces[7]; !ok {
+		t.Fatalf("Failed piece not remembered")
+	}
+
+	// Another peer sends a good copy; only the second block differs.
+	ts.pieceSucceeded(&ActivePiece{index: 7, sources: []string{"3.3.3.3:3", "3.3.3.3:3"}}, good)
+	if ts.strikes["2.2.2.2"] != 1 || ts.strikes["1.1.1.1"] != 0 || ts.strikes["3.3.3.3"] != 0 {
+		t.Errorf("Wrong strikes %v", ts.strikes)
+	}
+	if _, ok := ts.badPieces[7]; ok {
+		t.Errorf("Good piece still remembered as bad")
+	}
+
+	// Without the data, a good copy clears the peers that sent it.
+	ts.pieceFailed(&ActivePiece{index: 8, sources: []string{"1.1.1.1:1", "2.2.2.2:2"}}, nil)
+	ts.pieceSucceeded(&ActivePiece{index: 8, sources: []string{"1.1.1.1:1", "1.1.1.1:1"}}, nil)
+	if ts.strikes["2.2.2.2"] != 2 || ts.strikes["1.1.1.1"] != 0 {
+		t.Errorf("Wrong strikes %v", ts.strikes)
+	}
+
+	// A piece from one peer alone needs no second opinion.
+	ts.pieceFailed(&ActivePiece{index: 9, sources: []string{"2.2.2.2:5", "2.2.2.2:5"}}, bad)
+	if !ts.isBanned("2.2.2.2:6") {
+		t.Errorf("Peer not banned after %d strikes", BAN_STRIKES)
+	}
+	if ts.isBanned("1.1.1.1:1") {
+		t.Errorf("Innocent peer banned")
+	}
+}
+
+func TestMayRetry(t *testing.T) {
+	ts := newBanTestSession()
+	suspect := &peerState{address: "1.1.1.1:1", have: NewBitset(10)}
+	other := &peerState{address: "3.3.3.3:3", have: NewBitset(10)}
+	suspect.have.Set(7)
+	ts.peers[suspect.address] = suspect
+	ts.peers[other.address] = other
+	ts.pieceFailed(&ActivePiece{index: 7, sources: []string{"1.1.1.1:1", "2.2.2.2:2"}}, nil)
+	if !ts.mayRetry(suspect, 7) {
+		t.Errorf("Suspect should retry when nobody else has the piece")
+	}
+	other.have.Set(7)
+	if ts.mayRetry(suspect, 7) || !ts.mayRetry(other, 7) {
+		t.Errorf("Piece should be retried from the peer that wasn't involved")
+	}
+	v := &ActivePiece{index: 7, pinned: other.address}
+	if ts.mayDownload(suspect, v) || !ts.mayDownload(other, v) {
+		t.Errorf("Pinned piece should only come from its peer")
+	}
+}
@@ -33,6 +33,11 @@ func NewBitsetFromBytes(n int, data []byte) *Bitset {
 	return bitset
 }
 
+// Bytes returns the bitset as sent in a BITFIELD message. It is not a copy.
+func (b *Bitset) Bytes() []byte {
+	return b.b
+}
+
 func (b *Bitset) Set(index int) {
 	if index < 0 || index >= b.n {
 		panic("Index out of range.")
@@ -77,6 +82,16 @@ func (b *Bitset) IsEndValid() bool {
 	return true
 }
 
+// Count returns how many bits are set.
+func (b *Bitset) Count() (n int) {
+	for i := 0; i < b.n; i++ {
+		if b.IsSet(i) {
+			n++
+		}
+	}
+	return
+}
+
 // TODO: Make this fast
 func (b *Bitset) FindNextSet(index int) int {
 	for i := index; i < b.n; i++ {
@@ -0,0 +1,271 @@
+package main
+
+// IP blocklists. We neither dial nor accept peers in a blocked range. Lists
+// can be in eMule dat, PeerGuardian p2p or CIDR format, optionally gzipped,
+// and are loaded again on SIGHUP.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var blocklistFiles string
+
+func init() {
+	flag.StringVar(&blocklistFiles, "blocklist", "", "Comma separated list of IP blocklist files, in eMule dat, "+
+		"PeerGuardian p2p or CIDR format, optionally gzipped. Send SIGHUP to load them again.")
+}
+
+// An inclusive range of addresses, in 16 byte form.
+type ipRange struct {
+	first, last net.IP
+}
+
+// ipBlocklist is a sorted list of ranges that don't overlap.
+type ipBlocklist struct {
+	ranges []ipRange
+}
+
+var blocklistMu sync.RWMutex
+var blocklist *ipBlocklist
+var blocklistVersion int // Changes every time a list is loaded
+
+// newIPBlocklist sorts ranges and merges the ones that overlap or touch.
+func newIPBlocklist(ranges []ipRange) *ipBlocklist {
+	sort.Sort(byFirst(ranges))
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, nextIP(merged[n-1].last)) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return &ipBlocklist{merged}
+}
+
+type byFirst []ipRange
+
+func (r byFirst) Len() int           { return len(r) }
+func (r byFirst) Less(i, j int) bool { return bytes.Compare(r[i].first, r[j].first) < 0 }
+func (r byFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// nextIP returns ip+1, or ip itself if it is the last address.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return ip
+}
+
+func (b *ipBlocklist) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].last, ip) >= 0
+	})
+	return i < len(b.ranges) && bytes.Compare(b.ranges[i].first, ip) <= 0
+}
+
+// isBlocked is whether a peer address, host:port, is on the blocklist.
+func isBlocked(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	return blocklist != nil && blocklist.contains(ip)
+}
+
+// parseBlocklistLine parses one line of any of the supported formats. ok is
+// false for comments, blank lines and eMule entries that allow access.
+func parseBlocklistLine(line string) (r ipRange, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+		return
+	}
+	if ip := net.ParseIP(line); ip != nil {
+		return ipRange{ip.To16(), ip.To16()}, true, nil
+	}
+	if strings.Contains(line, "/") {
+		var ipNet *net.IPNet
+		if _, ipNet, err = net.ParseCIDR(line); err != nil {
+			return
+		}
+		first := ipNet.IP.To16()
+		last := make(net.IP, len(first))
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		return ipRange{first, last}, true, nil
+	}
+	span := line
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Count(line[i+1:], ".") == 6 {
+		// PeerGuardian: description:first-last. The description may hold
+		// anything, including commas and colons.
+		span = line[i+1:]
+	} else if fields := strings.Split(line, ","); len(fields) >= 2 {
+		// eMule: first - last , level , description. Levels above 127
+		// allow access.
+		span = fields[0]
+		level, err2 := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err2 != nil {
+			err = errors.New("Bad access level in " + strconv.Quote(line))
+			return
+		}
+		if level > 127 {
+			return
+		}
+	}
+	ends := strings.SplitN(span, "-", 2)
+	if len(ends) != 2 {
+		err = errors.New("Can't parse blocklist line " + strconv.Quote(line))
+		return
+	}
+	r.first = parseBlocklistIP(ends[0])
+	r.last = parseBlocklistIP(ends[1])
+	if r.first == nil || r.last == nil || bytes.Compare(r.first, r.last) > 0 {
+		err = errors.New("Bad address range in " + strconv.Quote(line))
+		return
+	}
+	return r, true, nil
+}
+
+// parseBlocklistIP parses an address in 16 byte form. eMule lists pad IPv4
+// addresses with zeros, like 001.002.003.004, which net.ParseIP rejects.
+func parseBlocklistIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	var b [4]byte
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
+
+// readBlocklist reads the ranges in one list, gunzipping it if need be.
+func readBlocklist(in io.Reader) (ranges []ipRange, err error) {
+	br := bufio.NewReader(in)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	scanner := bufio.NewScanner(br)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		r, ok, err2 := parseBlocklistLine(scanner.Text())
+		if err2 != nil {
+			return nil, errors.New("Line " + strconv.Itoa(lineNumber) + ": " + err2.Error())
+		}
+		if ok {
+			ranges = append(ranges, r)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// loadBlocklists reads the -blocklist files and replaces the current list.
+// If any of them can't be read the current list stays.
+func loadBlocklists() (err error) {
+	var ranges []ipRange
+	for _, name := range strings.Split(blocklistFiles, ",") {
+		var f *os.File
+		if f, err = os.Open(name); err != nil {
+			return
+		}
+		r, err2 := readBlocklist(f)
+		f.Close()
+		if err2 != nil {
+			return errors.New(name + ": " + err2.Error())
+		}
+		ranges = append(ranges, r...)
+	}
+	list := newIPBlocklist(ranges)
+	blocklistMu.Lock()
+	blocklist = list
+	blocklistVersion++
+	blocklistMu.Unlock()
+	peerLog.Info("Loaded blocklist", "ranges", len(list.ranges))
+	return
+}
+
+// closeBlockedPeers drops peers that a newly loaded blocklist covers.
+func (t *TorrentSession) closeBlockedPeers() {
+	for _, p := range t.peers {
+		if isBlocked(p.address) {
+			p.log.Info("Peer is now blocked")
+			t.ClosePeer(p)
+		}
+	}
+}
+
+func currentBlocklistVersion() int {
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	return blocklistVersion
+}
+
+// initBlocklist loads the -blocklist files, and loads them again whenever
+// we get SIGHUP.
+func initBlocklist() (err error) {
+	if blocklistFiles == "" {
+		return
+	}
+	if err = loadBlocklists(); err != nil {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			if err := loadBlocklists(); err != nil {
+				peerLog.Error("Could not reload blocklist, keeping the old one", "err", err)
+			}
+		}
+	}()
+	return
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# Comments and blank lines are ignored
+
+001.002.003.000 - 001.002.003.255 , 000 , eMule entry
+005.000.000.000 - 005.255.255.255 , 200 , Allowed by access level
+Some Company, Inc: Ltd:10.0.0.0-10.0.0.9
+10.0.0.10-10.0.0.20
+192.168.0.0/16
+2001:db8::/32
+8.8.8.8
+`
+
+func TestBlocklist(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		var in bytes.Buffer
+		if gzipped {
+			w := gzip.NewWriter(&in)
+			w.Write([]byte(testBlocklist))
+			w.Close()
+		} else {
+			in.WriteString(testBlocklist)
+		}
+		ranges, err := readBlocklist(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := newIPBlocklist(ranges)
+		// The two 10.0.0.x ranges touch, so they are merged.
+		if len(list.ranges) != 5 {
+			t.Errorf("Wanted 5 ranges, got %d", len(list.ranges))
+		}
+		tests := []struct {
+			ip      string
+			blocked bool
+		}{
+			{"1.2.3.4", true},
+			{"1.2.4.0", false},
+			{"5.1.1.1", false},
+			{"10.0.0.0", true},
+			{"10.0.0.20", true},
+			{"10.0.0.21", false},
+			{"192.168.200.1", true},
+			{"192.169.0.0", false},
+			{"8.8.8.8", true},
+			{"8.8.8.9", false},
+			{"2001:db8::1", true},
+			{"2001:db9::1", false},
+		}
+		for _, test := range tests {
+			if got := list.contains(net.ParseIP(test.ip)); got != test.blocked {
+				t.Errorf("gzipped %v: %s blocked = %v, wanted %v", gzipped, test.ip, got, test.blocked)
+			}
+		}
+	}
+}
+
+func TestBlocklistErrors(t *testing.T) {
+	for _, line := range []string{"nonsense", "1.2.3.4-1.2.3", "1.2.3.9 - 1.2.3.0 , 0 , backwards", "1.2.3.0/33"} {
+		if _, err := readBlocklist(strings.NewReader(line)); err == nil {
+			t.Errorf("Accepted %q", line)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+// Blocks we download are kept in memory until their piece is complete. Then
+// the piece is hashed from memory and written to disk in one go by a
+// background writer. If the cache gets too big, the fullest pieces are
+// flushed to disk early and hashed from disk once they complete.
+
+import (
+	"crypto/sha1"
+	"flag"
+	"time"
+)
+
+var cacheSize int
+
+func init() {
+	flag.IntVar(&cacheSize, "cacheSize", 32, "Size of the disk write cache in MiB.")
+}
+
+type diskWrite struct {
+	piece    int
+	active   *ActivePiece
+	offset   int64  // Global offset of data
+	data     []byte // nil for a complete piece that was flushed early
+	complete bool   // Last write for the piece. Hash it, and report back.
+	good     bool   // For complete pieces, whether the hash matched
+	err      error
+}
+
+func (t *TorrentSession) startDiskWriter() {
+	t.diskWrites = make(chan *diskWrite)
+	t.diskWritesDone = make(chan *diskWrite)
+	t.diskWritesGone = make(chan struct{})
+	queue := make(chan *diskWrite)
+	go queueingDiskWriter(t.diskWrites, queue)
+	go t.diskWriter(queue)
+}
+
+// queueingDiskWriter buffers any number of writes, so the main loop never
+// waits on the disk. The cache size limit keeps the queue from growing
+// without bound.
+func queueingDiskWriter(in, out chan *diskWrite) {
+	var queue []*diskWrite
+L:
+	for {
+		if len(queue) == 0 {
+			w, ok := <-in
+			if !ok {
+				break L
+			}
+			queue = append(queue, w)
+		} else {
+			select {
+			case w, ok := <-in:
+				if !ok {
+					break L
+				}
+				queue = append(queue, w)
+			case out <- queue[0]:
+				queue[0] = nil
+				queue = queue[1:]
+			}
+		}
+	}
+	for _, w := range queue {
+		out <- w
+	}
+	close(out)
+}
+
+// diskWriter does the writes in order, so a complete piece that was flushed
+// early is only hashed after all its blocks are on disk.
+func (t *TorrentSession) diskWriter(in chan *diskWrite) {
+	for w := range in {
+		select {
+		case <-t.diskWritesGone:
+			// Shutdown gave up on us. Drop the rest.
+			continue
+		default:
+		}
+		start := time.Now()
+		switch {
+		case !w.complete:
+			_, w.err = t.fileStore.WriteAt(w.data, w.offset)
+		case w.data == nil:
+			w.good, w.err = checkPiece(t.fileStore, t.totalSize, t.m, w.piece)
+		default:
+			w.good = checkPieceData(t.m, w.piece, w.data)
+			if w.good {
+				_, w.err = t.fileStore.WriteAt(w.data, w.offset)
+			}
+		}
+		t.metrics.observe(&t.metrics.diskWriteLatency, time.Now().Sub(start))
+		select {
+		case t.diskWritesDone <- w:
+		case <-t.diskWritesGone:
+		}
+	}
+	// Shutdown waits for this.
+	close(t.diskWritesDone)
+}
+
+func checkPieceData(m *MetaInfo, pieceIndex int, data []byte) bool {
+	hasher := sha1.New()
+	hasher.Write(data)
+	base := pieceIndex * sha1.Size
+	return checkEqual(m.Info.Pieces[base:base+sha1.Size], hasher.Sum(nil))
+}
+
+// cacheBlock keeps a downloaded block until its piece is complete.
+func (t *TorrentSession) cacheBlock(v *ActivePiece, block int, data []byte) {
+	if v.blocks == nil {
+		v.blocks = make([][]byte, len(v.downloaderCount))
+	}
+	v.blocks[block] = data
+	t.cacheUsed += int64(len(data))
+	if t.cacheUsed > int64(cacheSize)*1024*1024 {
+		t.flushCache()
+	}
+}
+
+// flushCache writes out the blocks of the active piece that holds the most
+// of them.
+func (t *TorrentSession) flushCache() {
+	var fullest *ActivePiece
+	var most int64
+	for _, v := range t.activePieces {
+		if n := v.cachedBytes(); !v.writing && n > most {
+			fullest, most = v, n
+		}
+	}
+	if fullest != nil {
+		t.writeBlocks(fullest)
+		fullest.flushed = true
+	}
+}
+
+// writeBlocks queues writes for the cached blocks of a piece, joining
+// neighbouring blocks into a single write.
+func (t *TorrentSession) writeBlocks(v *ActivePiece) {
+	pieceOffset := int64(v.index) * t.m.Info.PieceLength
+	for i := 0; i < len(v.blocks); {
+		if v.blocks[i] == nil {
+			i++
+			continue
+		}
+		start := i
+		var data []byte
+		for ; i < len(v.blocks) && v.blocks[i] != nil; i++ {
+			data = append(data, v.blocks[i]...)
+			v.blocks[i] = nil
+		}
+		t.diskWrites <- &diskWrite{piece: v.index, active: v,
+			offset: pieceOffset + int64(start*STANDARD_BLOCK_LENGTH), data: data}
+	}
+}
+
+// writePiece hands a piece whose blocks have all arrived to the disk writer,
+// which checks its hash.
+func (t *TorrentSession) writePiece(v *ActivePiece) {
+	v.writing = true
+	offset := int64(v.index) * t.m.Info.PieceLength
+	if v.flushed {
+		t.writeBlocks(v)
+		t.diskWrites <- &diskWrite{piece: v.index, active: v, offset: offset, complete: true}
+		return
+	}
+	data := make([]byte, 0, v.pieceLength)
+	for i, b := range v.blocks {
+		data = append(data, b...)
+		v.blocks[i] = nil
+	}
+	t.diskWrites <- &diskWrite{piece: v.index, active: v, offset: offset, data: data, complete: true}
+}
+
+// diskWriteDone is called on the main goroutine once the writer is done with w.
+func (t *TorrentSession) diskWriteDone(w *diskWrite) {
+	throttled := t.cacheFull()
+	t.cacheUsed -= int64(len(w.data))
+	// The piece may have failed, and be downloading again, since this write
+	// was queued.
+	current := t.activePieces[w.piece] == w.active
+	if w.err != nil {
+		// Don't trust the piece. It will be downloaded again.
+		t.logger(storageLog).Error("Could not write piece", "piece", w.piece, "err", w.err)
+		if current {
+			t.dropActivePiece(w.active)
+		}
+	} else if w.complete && current {
+		t.dropActivePiece(w.active)
+		if w.good {
+			t.pieceCompleted(w.piece, w.active.pieceLength)
+			t.pieceSucceeded(w.active, w.data)
+		} else {
+			t.pieceFailed(w.active, w.data)
+		}
+	}
+	if throttled && !t.cacheFull() {
+		for _, p := range t.peers {
+			if err := t.fillPipeline(p); err != nil {
+				p.log.Info("Closing peer", "err", err)
+				t.ClosePeer(p)
+			}
+		}
+	}
+}
+
+// dropActivePiece forgets a piece we are no longer downloading, along with
+// any of its blocks still in the cache.
+func (t *TorrentSession) dropActivePiece(v *ActivePiece) {
+	t.cacheUsed -= v.cachedBytes()
+	v.blocks = nil
+	delete(t.activePieces, v.index)
+}
+
+// cacheFull is true when the disk has fallen so far behind that we should
+// stop asking for more data.
+func (t *TorrentSession) cacheFull() bool {
+	return t.cacheUsed > 2*int64(cacheSize)*1024*1024
+}
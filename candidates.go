@@ -0,0 +1,200 @@
+package main
+
+// Peers we hear about from trackers and the DHT go into a pool of
+// candidates. We dial them a few at a time, back off from the ones that
+// don't answer, and stay within limits on connections per session and for
+// the whole process.
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+var maxPeers int
+var maxGlobalPeers int
+var maxHalfOpen int
+
+func init() {
+	flag.IntVar(&maxPeers, "maxPeers", MAX_NUM_PEERS, "Most peers to be connected to for each torrent.")
+	flag.IntVar(&maxGlobalPeers, "maxGlobalPeers", 4*MAX_NUM_PEERS, "Most peers to be connected to for all torrents together.")
+	flag.IntVar(&maxHalfOpen, "maxHalfOpen", 8, "Most outgoing peer connections to have in progress at once.")
+}
+
+const (
+	PEER_DIAL_TIMEOUT = 20 * time.Second
+	MAX_CANDIDATES    = 1000 // Per session
+	MAX_DIAL_FAILURES = 5    // In a row, before we forget a candidate
+	MIN_RETRY_DELAY   = 30 * time.Second
+	MAX_RETRY_DELAY   = 30 * time.Minute
+)
+
+// Where we heard about a candidate.
+const (
+	SOURCE_TRACKER  = "tracker"
+	SOURCE_DHT      = "dht"
+	SOURCE_INCOMING = "incoming" // The peer contacted us
+)
+
+type peerCandidate struct {
+	address  string
+	source   string
+	failures int       // Failed dials in a row
+	nextTry  time.Time // Don't dial before this
+	dialing  bool
+}
+
+type dialResult struct {
+	address string
+	conn    net.Conn // nil if the dial failed
+	err     error
+}
+
+// Connection counts for all sessions together.
+var connLimitsMu sync.Mutex
+var globalPeers int
+var globalHalfOpen int
+
+func reserveDial() bool {
+	connLimitsMu.Lock()
+	defer connLimitsMu.Unlock()
+	if globalHalfOpen >= maxHalfOpen || globalPeers+globalHalfOpen >= maxGlobalPeers {
+		return false
+	}
+	globalHalfOpen++
+	return true
+}
+
+func releaseDial() {
+	connLimitsMu.Lock()
+	globalHalfOpen--
+	connLimitsMu.Unlock()
+}
+
+func reservePeer() bool {
+	connLimitsMu.Lock()
+	defer connLimitsMu.Unlock()
+	if globalPeers >= maxGlobalPeers {
+		return false
+	}
+	globalPeers++
+	return true
+}
+
+func releasePeer() {
+	connLimitsMu.Lock()
+	globalPeers--
+	connLimitsMu.Unlock()
+}
+
+// retryDelay is how long to wait before dialing a peer again after it
+// failed this many times in a row.
+func retryDelay(failures int) time.Duration {
+	delay := MIN_RETRY_DELAY
+	for i := 1; i < failures && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	return delay
+}
+
+func dialPeer(address string) (net.Conn, error) {
+	if useProxy() {
+		// The proxy has timeouts of its own.
+		return proxyNetDial("tcp", address)
+	}
+	return net.DialTimeout("tcp", address, PEER_DIAL_TIMEOUT)
+}
+
+// addCandidate adds a peer to the pool, unless we know it already. It
+// returns whether the peer is new.
+func (t *TorrentSession) addCandidate(address, source string) bool {
+	if _, ok := t.peers[address]; ok || !t.mayConnect(address) {
+		return false
+	}
+	if _, ok := t.candidates[address]; ok || len(t.candidates) >= MAX_CANDIDATES {
+		return false
+	}
+	t.candidates[address] = &peerCandidate{address: address, source: source}
+	return true
+}
+
+// dialCandidates starts dials to as many candidates as the limits allow.
+func (t *TorrentSession) dialCandidates() {
+	if t.seeding.paused {
+		return
+	}
+	now := time.Now()
+	for _, c := range t.candidates {
+		if len(t.peers)+t.halfOpen >= maxPeers {
+			return
+		}
+		if c.dialing || now.Before(c.nextTry) {
+			continue
+		}
+		if _, ok := t.peers[c.address]; ok {
+			continue
+		}
+		if !t.mayConnect(c.address) {
+			delete(t.candidates, c.address)
+			continue
+		}
+		if !reserveDial() {
+			return
+		}
+		c.dialing = true
+		t.halfOpen++
+		go func(address string) {
+			conn, err := dialPeer(address)
+			select {
+			case t.dialResults <- &dialResult{address, conn, err}:
+			case <-t.ctx.Done():
+				// Nobody is left to count it.
+				releaseDial()
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}(c.address)
+	}
+}
+
+// dialDone is called on the main goroutine when a dial finishes.
+func (t *TorrentSession) dialDone(r *dialResult) {
+	t.halfOpen--
+	releaseDial()
+	c := t.candidates[r.address]
+	if c != nil {
+		c.dialing = false
+	}
+	if r.err != nil {
+		t.logger(peerLog).Debug("Failed to connect", "peer", r.address, "err", r.err)
+		if c != nil {
+			c.failures++
+			if c.failures >= MAX_DIAL_FAILURES {
+				delete(t.candidates, r.address)
+			} else {
+				c.nextTry = time.Now().Add(retryDelay(c.failures))
+			}
+		}
+	} else {
+		source := ""
+		if c != nil {
+			c.failures = 0
+			source = c.source
+		}
+		t.addPeer(r.conn, source)
+	}
+	t.dialCandidates()
+}
+
+// peerClosed keeps us from dialing a peer again straight after we dropped
+// it, or it dropped us.
+func (t *TorrentSession) peerClosed(address string) {
+	if c, ok := t.candidates[address]; ok {
+		c.nextTry = time.Now().Add(MIN_RETRY_DELAY)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{1, MIN_RETRY_DELAY},
+		{2, 2 * MIN_RETRY_DELAY},
+		{3, 4 * MIN_RETRY_DELAY},
+		{100, MAX_RETRY_DELAY},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.failures); got != test.delay {
+			t.Errorf("retryDelay(%d) = %v, wanted %v", test.failures, got, test.delay)
+		}
+	}
+}
+
+func TestDialCandidates(t *testing.T) {
+	// Nothing listens on these, so every dial fails.
+	var addresses []string
+	for i := 0; i < 5; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, l.Addr().String())
+		l.Close()
+	}
+	defer func(old int) { maxHalfOpen = old }(maxHalfOpen)
+	maxHalfOpen = 2
+	ts := &TorrentSession{peers: make(map[string]*peerState),
+		candidates:  make(map[string]*peerCandidate),
+		dialResults: make(chan *dialResult),
+		ctx:         context.Background()}
+	for _, a := range addresses {
+		if !ts.addCandidate(a, SOURCE_TRACKER) {
+			t.Errorf("Candidate %s not added", a)
+		}
+	}
+	if ts.addCandidate(addresses[0], SOURCE_DHT) {
+		t.Errorf("Candidate added twice")
+	}
+	ts.dialCandidates()
+	dials := 0
+	for ts.halfOpen > 0 {
+		if ts.halfOpen > maxHalfOpen {
+			t.Fatalf("%d dials in progress, limit is %d", ts.halfOpen, maxHalfOpen)
+		}
+		ts.dialDone(<-ts.dialResults)
+		dials++
+	}
+	if dials != len(addresses) {
+		t.Errorf("Wanted %d dials, got %d", len(addresses), dials)
+	}
+	for _, c := range ts.candidates {
+		if c.failures != 1 || c.nextTry.Before(time.Now().Add(MIN_RETRY_DELAY/2)) {
+			t.Errorf("Candidate %s: %d failures, next try at %v", c.address, c.failures, c.nextTry)
+		}
+	}
+	if globalHalfOpen != 0 {
+		t.Errorf("Global half open count is %d", globalHalfOpen)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// The choker decides which peers may download from us. Every
+// RECHOKE_INTERVAL we unchoke the UNCHOKE_SLOTS interested peers that give
+// us the most, by download rate, or once we only seed, the ones that take
+// the most, by upload rate. One more slot goes to a random interested peer,
+// changed every OPTIMISTIC_UNCHOKE_INTERVAL, so new peers get a chance to
+// show what they can do.
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	UNCHOKE_SLOTS               = 4
+	RECHOKE_INTERVAL            = 10 * time.Second
+	OPTIMISTIC_UNCHOKE_INTERVAL = 30 * time.Second
+)
+
+type chokeState struct {
+	lastRechoke    time.Time
+	lastOptimistic time.Time
+	optimistic     *peerState // The peer unchoked at random, or nil
+}
+
+// rechoke chokes and unchokes peers once RECHOKE_INTERVAL has passed since
+// the last time.
+func (t *TorrentSession) rechoke(now time.Time) {
+	if now.Sub(t.choke.lastRechoke) < RECHOKE_INTERVAL {
+		return
+	}
+	t.choke.lastRechoke = now
+	var interested []*peerState
+	for _, p := range t.peers {
+		if p.peer_interested {
+			interested = append(interested, p)
+		}
+	}
+	rate := func(p *peerState) float64 {
+		if t.seeding.complete {
+			return p.uploadRate
+		}
+		return p.downloadRate
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+	unchoke := make(map[*peerState]bool)
+	for i := 0; i < len(interested) && i < UNCHOKE_SLOTS; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	o := t.choke.optimistic
+	if o != nil && (t.peers[o.address] != o || !o.peer_interested || unchoke[o] ||
+		now.Sub(t.choke.lastOptimistic) >= OPTIMISTIC_UNCHOKE_INTERVAL) {
+		o = nil
+	}
+	if o == nil && len(interested) > UNCHOKE_SLOTS {
+		rest := interested[UNCHOKE_SLOTS:]
+		o = rest[rand.Intn(len(rest))]
+		t.choke.lastOptimistic = now
+	}
+	t.choke.optimistic = o
+	if o != nil {
+		unchoke[o] = true
+	}
+
+	for _, p := range t.peers {
+		p.SetChoke(!unchoke[p])
+	}
+}
+
+// peerInterested unchokes a peer that became interested right away, if a
+// slot is free, rather than making it wait for the next rechoke.
+func (t *TorrentSession) peerInterested(p *peerState) {
+	if !p.am_choking {
+		return
+	}
+	unchoked := 0
+	for _, q := range t.peers {
+		if !q.am_choking {
+			unchoked++
+		}
+	}
+	if unchoked < UNCHOKE_SLOTS+1 {
+		p.SetChoke(false)
+	}
+}
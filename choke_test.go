@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newChokeTestSession(n int) (ts *TorrentSession, peers []*peerState) {
+	ts = &TorrentSession{peers: make(map[string]*peerState)}
+	for i := 0; i < n; i++ {
+		p := NewPeerState(nil)
+		p.address = "10.0.0." + strconv.Itoa(i) + ":6881"
+		p.peer_interested = true
+		// Peer i downloads fast and uploads slowly, the higher i is.
+		p.downloadRate = float64(i)
+		p.uploadRate = float64(n - i)
+		ts.peers[p.address] = p
+		peers = append(peers, p)
+	}
+	return
+}
+
+func unchokedPeers(peers []*peerState) (unchoked []int) {
+	for i, p := range peers {
+		if !p.am_choking {
+			unchoked = append(unchoked, i)
+		}
+	}
+	return
+}
+
+func TestRechoke(t *testing.T) {
+	ts, peers := newChokeTestSession(8)
+	peers[7].peer_interested = false
+	now := time.Now()
+	ts.rechoke(now)
+	// The four best interested peers by download rate, and one at random.
+	for _, i := range []int{3, 4, 5, 6} {
+		if peers[i].am_choking {
+			t.Errorf("Peer %d choked while downloading, unchoked %v", i, unchokedPeers(peers))
+		}
+	}
+	o := ts.choke.optimistic
+	if o == nil || o.am_choking || o.downloadRate > 2 || len(unchokedPeers(peers)) != UNCHOKE_SLOTS+1 {
+		t.Errorf("Bad optimistic unchoke, unchoked %v", unchokedPeers(peers))
+	}
+
+	// Too soon to change anything.
+	before := fmt.Sprint(unchokedPeers(peers))
+	ts.seeding.complete = true
+	ts.rechoke(now.Add(time.Second))
+	if got := fmt.Sprint(unchokedPeers(peers)); got != before {
+		t.Errorf("Rechoked before RECHOKE_INTERVAL, unchoked %v, then %v", before, got)
+	}
+
+	// Seeding, the peers that take the most from us win.
+	ts.rechoke(now.Add(OPTIMISTIC_UNCHOKE_INTERVAL))
+	for _, i := range []int{0, 1, 2, 3} {
+		if peers[i].am_choking {
+			t.Errorf("Peer %d choked while seeding, unchoked %v", i, unchokedPeers(peers))
+		}
+	}
+	if !peers[7].am_choking || len(unchokedPeers(peers)) != UNCHOKE_SLOTS+1 {
+		t.Errorf("Unchoked %v", unchokedPeers(peers))
+	}
+}
+
+func TestPeerInterestedUsesFreeSlot(t *testing.T) {
+	ts, peers := newChokeTestSession(UNCHOKE_SLOTS + 2)
+	for _, p := range peers {
+		ts.peerInterested(p)
+	}
+	if got := unchokedPeers(peers); len(got) != UNCHOKE_SLOTS+1 {
+		t.Errorf("Unchoked %v", got)
+	}
+}
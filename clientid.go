@@ -0,0 +1,78 @@
+package main
+
+// Telling which client a peer runs from its peer id.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Clients that use Azureus style ids: -XX1234- and random bytes.
+var azureusClients = map[string]string{
+	"AG": "Ares", "AZ": "Vuze", "BB": "BitBuddy", "BC": "BitComet", "BI": "BiglyBT",
+	"BT": "BitTorrent", "BW": "BitWombat", "CD": "Enhanced CTorrent", "DE": "Deluge",
+	"FD": "Free Download Manager", "FG": "FlashGet", "FX": "Freebox", "HL": "Halite",
+	"KT": "KTorrent", "LP": "Lphant", "LT": "libtorrent", "lt": "rTorrent", "LW": "LimeWire",
+	"MO": "MonoTorrent", "PI": "PicoTorrent", "qB": "qBittorrent", "SD": "Thunder",
+	"SZ": "Shareaza", "TIX": "Tixati", "TR": "Transmission", "UM": "µTorrent Mac",
+	"UT": "µTorrent", "UW": "µTorrent Web", "WW": "WebTorrent", "XL": "Xunlei", "ZT": "ZipTorrent",
+}
+
+// Clients that use Shadow style ids: a letter, then version characters.
+var shadowClients = map[byte]string{
+	'A': "ABC", 'O': "Osprey Permaseed", 'Q': "BTQueue", 'R': "Tribler", 'S': "Shadow",
+	'T': "BitTornado", 'U': "UPnP NAT Bit Torrent",
+}
+
+// clientName decodes a peer id into a client name and version, or returns
+// "" if it doesn't look like any we know.
+func clientName(id string) string {
+	if len(id) != 20 {
+		return ""
+	}
+	if strings.HasPrefix(id, "-tt") {
+		// peerId's own format.
+		return "Taipei-Torrent"
+	}
+	if id[0] == '-' && id[7] == '-' {
+		if name, ok := azureusClients[id[1:3]]; ok {
+			return name + " " + dottedVersion(id[3:7])
+		}
+		return ""
+	}
+	if id[0] == 'M' && id[2] == '-' {
+		// Mainline: M7-4-2--
+		end := strings.Index(id[1:], "--")
+		if end < 0 {
+			return "BitTorrent"
+		}
+		return "BitTorrent " + strings.Replace(id[1:1+end], "-", ".", -1)
+	}
+	if name, ok := shadowClients[id[0]]; ok {
+		version := strings.TrimRight(id[1:6], "-")
+		return name + " " + dottedVersion(version)
+	}
+	return ""
+}
+
+// dottedVersion turns version characters like "355A" into "3.5.5.A".
+// Characters past '9' count on from 10, as in Shadow style ids.
+func dottedVersion(v string) string {
+	var parts []string
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c >= '0' && c <= '9':
+			parts = append(parts, string(c))
+		case c >= 'A' && c <= 'Z':
+			parts = append(parts, strconv.Itoa(int(c-'A')+10))
+		case c >= 'a' && c <= 'z':
+			parts = append(parts, strconv.Itoa(int(c-'a')+36))
+		case c == '.':
+			parts = append(parts, "62")
+		default:
+			parts = append(parts, "?")
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		id, name string
+	}{
+		{"-UT3550-abcdefghijkl", "µTorrent 3.5.5.0"},
+		{"-qB4250-abcdefghijkl", "qBittorrent 4.2.5.0"},
+		{"-TR2940-abcdefghijkl", "Transmission 2.9.4.0"},
+		{"-XX1000-abcdefghijkl", ""},
+		{"M7-4-2--abcdefghijkl", "BitTorrent 7.4.2"},
+		{"T03I--abcdefghijklmn", "BitTornado 0.3.18"},
+		{"-tt1234_567890123456", "Taipei-Torrent"},
+		{"short", ""},
+		{"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09", ""},
+	}
+	for _, test := range tests {
+		if name := clientName(test.id); name != test.name {
+			t.Errorf("clientName(%q) = %q, wanted %q", test.id, name, test.name)
+		}
+	}
+}
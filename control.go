@@ -0,0 +1,319 @@
+package main
+
+// Controlling a running session from other goroutines. Everything that
+// touches the session's state runs on its main goroutine, through do.
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// File priorities. We either download a file or skip it.
+const (
+	PRIORITY_SKIP   = 0
+	PRIORITY_NORMAL = 1
+)
+
+// do runs f on the session's main goroutine and waits for it to finish.
+// Safe to call from any goroutine.
+func (t *TorrentSession) do(f func()) (err error) {
+	done := make(chan bool)
+	select {
+	case t.control <- func() { f(); close(done) }:
+	case <-t.ctx.Done():
+		return errors.New("Session stopped.")
+	}
+	<-done
+	return
+}
+
+// Pause drops all peers and leaves the swarm until Resume.
+func (t *TorrentSession) Pause() error {
+	return t.do(func() {
+		if !t.seeding.paused {
+			t.pause()
+		}
+	})
+}
+
+func (t *TorrentSession) Resume() error {
+	return t.do(t.resume)
+}
+
+func (t *TorrentSession) resume() {
+	if !t.seeding.paused {
+		return
+	}
+	t.seeding.paused = false
+	// A goal that paused us would pause us again at once.
+	t.seeding.seedingSince = time.Time{}
+	t.seeding.lastUpload = time.Time{}
+	if t.downloadComplete() {
+		t.seeding.seedingSince = time.Now()
+	}
+	if !trackerLessMode {
+		t.fetchTrackerInfo("started")
+	}
+	t.dialCandidates()
+}
+
+// SetFilePriority chooses whether to download file i.
+func (t *TorrentSession) SetFilePriority(i, priority int) (err error) {
+	if priority != PRIORITY_SKIP && priority != PRIORITY_NORMAL {
+		return errors.New("Unknown priority " + fmt.Sprint(priority) + ".")
+	}
+	err2 := t.do(func() { err = t.setFilePriority(i, priority) })
+	if err2 != nil {
+		return err2
+	}
+	return
+}
+
+func (t *TorrentSession) setFilePriority(i, priority int) (err error) {
+	numFiles := len(torrentFiles(&t.m.Info))
+	if i < 0 || i >= numFiles {
+		return errors.New("No such file.")
+	}
+	if priority != PRIORITY_SKIP && t.storeSkip != nil && t.storeSkip[i] {
+		// The store never created the file.
+		return errors.New("The file was skipped when the session started. Restart without it in -skipFiles.")
+	}
+	if t.filePriorities == nil {
+		t.filePriorities = make([]int, numFiles)
+		for j := range t.filePriorities {
+			t.filePriorities[j] = PRIORITY_NORMAL
+			if t.storeSkip != nil && t.storeSkip[j] {
+				t.filePriorities[j] = PRIORITY_SKIP
+			}
+		}
+	}
+	t.filePriorities[i] = priority
+	skip := make([]bool, numFiles)
+	for j, p := range t.filePriorities {
+		skip[j] = p == PRIORITY_SKIP
+	}
+	t.wantedPieces = wantedPieces(&t.m.Info, skip, t.totalPieces)
+	if t.downloadComplete() {
+		t.enterSeedingMode()
+	} else if t.seeding.complete {
+		// There is more to download after all.
+		t.seeding.complete = false
+		t.seeding.seedingSince = time.Time{}
+		t.si.Left = t.bytesLeft()
+	}
+	for _, p := range t.peers {
+		if p.have != nil {
+			t.checkInteresting(p)
+		}
+	}
+	return
+}
+
+// filePriority is the priority of file i.
+func (t *TorrentSession) filePriority(i int) int {
+	if t.filePriorities != nil {
+		return t.filePriorities[i]
+	}
+	if t.storeSkip != nil && t.storeSkip[i] {
+		return PRIORITY_SKIP
+	}
+	return PRIORITY_NORMAL
+}
+
+// bytesLeft is how much of the torrent we don't have.
+func (t *TorrentSession) bytesLeft() (left int64) {
+	for i := t.pieceSet.FindNextClear(0); i >= 0; i = t.pieceSet.FindNextClear(i + 1) {
+		left += t.pieceBytes(i)
+	}
+	return
+}
+
+func (t *TorrentSession) pieceBytes(piece int) int64 {
+	if piece == t.totalPieces-1 && t.lastPieceLength != 0 {
+		return int64(t.lastPieceLength)
+	}
+	return t.m.Info.PieceLength
+}
+
+// sessionRates are the transfer rates, in bytes per second, measured each
+// time updateRates is called.
+type sessionRates struct {
+	download, upload         float64
+	lastTime                 time.Time
+	lastDownload, lastUpload int64
+}
+
+func (t *TorrentSession) updateRates(now time.Time) {
+	r := &t.rates
+	if !r.lastTime.IsZero() {
+		if d := now.Sub(r.lastTime).Seconds(); d > 0 {
+			r.download = float64(t.si.Downloaded-r.lastDownload) / d
+			r.upload = float64(t.si.Uploaded-r.lastUpload) / d
+		}
+	}
+	r.lastTime, r.lastDownload, r.lastUpload = now, t.si.Downloaded, t.si.Uploaded
+}
+
+// trackerState is what we last heard from the tracker. It is written by the
+// announce goroutines.
+type trackerState struct {
+	mu           sync.Mutex
+	lastAnnounce time.Time
+	lastError    string
+}
+
+func (t *TorrentSession) announced(err string) {
+	t.tracker.mu.Lock()
+	t.tracker.lastAnnounce = time.Now()
+	t.tracker.lastError = err
+	t.tracker.mu.Unlock()
+}
+
+type SessionStatus struct {
+	InfoHash      string  `json:"infoHash"`
+	Name          string  `json:"name"`
+	State         string  `json:"state"` // downloading, seeding, paused or stopped
+	Error         string  `json:"error,omitempty"`
+	Size          int64   `json:"size"`
+	Left          int64   `json:"left"`
+	Downloaded    int64   `json:"downloaded"`
+	Uploaded      int64   `json:"uploaded"`
+	Ratio         float64 `json:"ratio"`
+	Pieces        int     `json:"pieces"`
+	GoodPieces    int     `json:"goodPieces"`
+	Peers         int     `json:"peers"`
+	DownloadRate  float64 `json:"downloadRate"` // Bytes per second
+	UploadRate    float64 `json:"uploadRate"`
+	ETA           int     `json:"eta"` // Seconds until the download is complete, -1 if unknown
+	UploadLimit   int     `json:"uploadLimit"`
+	DownloadLimit int     `json:"downloadLimit"`
+}
+
+type PeerStatus struct {
+	Address        string  `json:"address"`
+	Client         string  `json:"client"` // From the peer id, "" if unknown
+	Pieces         int     `json:"pieces"`
+	DownloadRate   float64 `json:"downloadRate"`
+	Choking        bool    `json:"choking"`
+	Interested     bool    `json:"interested"`
+	PeerChoking    bool    `json:"peerChoking"`
+	PeerInterested bool    `json:"peerInterested"`
+	Requests       int     `json:"requests"`
+	PeerRequests   int     `json:"peerRequests"`
+}
+
+type PieceStatus struct {
+	Pieces      int    `json:"pieces"`
+	PieceLength int64  `json:"pieceLength"`
+	GoodPieces  int    `json:"goodPieces"`
+	Bitfield    []byte `json:"bitfield"` // As in the BITFIELD message
+	Active      []int  `json:"active"`   // Pieces being downloaded
+}
+
+type TrackerStatus struct {
+	Announce     string    `json:"announce"`
+	LastAnnounce time.Time `json:"lastAnnounce"`
+	LastError    string    `json:"lastError,omitempty"`
+	Seeders      int       `json:"seeders"`
+	Leechers     int       `json:"leechers"`
+	Interval     int       `json:"interval"` // Seconds
+}
+
+type FileStatus struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Priority int    `json:"priority"`
+}
+
+// The status methods must run on the main goroutine, or after DoTorrent
+// returned.
+
+func (t *TorrentSession) status() (s SessionStatus) {
+	name, _ := torrentName(&t.m.Info)
+	s = SessionStatus{InfoHash: fmt.Sprintf("%x", t.m.InfoHash), Name: name,
+		Size: t.totalSize, Left: t.si.Left, Downloaded: t.si.Downloaded, Uploaded: t.si.Uploaded,
+		Ratio: t.shareRatio(), Pieces: t.totalPieces, GoodPieces: t.goodPieces, Peers: len(t.peers),
+		DownloadRate: t.rates.download, UploadRate: t.rates.upload,
+		UploadLimit: t.uploadLimit.Rate(), DownloadLimit: t.downloadLimit.Rate()}
+	s.ETA = -1
+	if t.seeding.complete {
+		s.ETA = 0
+	} else if s.DownloadRate > 0 {
+		s.ETA = int(float64(s.Left) / s.DownloadRate)
+	}
+	switch {
+	case t.ctx.Err() != nil:
+		s.State = "stopped"
+	case t.seeding.paused:
+		s.State = "paused"
+	case t.seeding.complete:
+		s.State = "seeding"
+	default:
+		s.State = "downloading"
+	}
+	return
+}
+
+func (t *TorrentSession) peerStatus() (peers []PeerStatus) {
+	peers = []PeerStatus{}
+	for _, p := range t.peers {
+		s := PeerStatus{Address: p.address, Client: clientName(p.id), DownloadRate: p.downloadRate,
+			Choking: p.am_choking, Interested: p.am_interested,
+			PeerChoking: p.peer_choking, PeerInterested: p.peer_interested,
+			Requests: len(p.our_requests), PeerRequests: len(p.peer_requests)}
+		if p.have != nil {
+			s.Pieces = p.have.Count()
+		}
+		peers = append(peers, s)
+	}
+	return
+}
+
+func (t *TorrentSession) pieceStatus() (s PieceStatus) {
+	s = PieceStatus{Pieces: t.totalPieces, PieceLength: t.m.Info.PieceLength, GoodPieces: t.goodPieces,
+		Bitfield: append([]byte(nil), t.pieceSet.Bytes()...), Active: []int{}}
+	for i := range t.activePieces {
+		s.Active = append(s.Active, i)
+	}
+	return
+}
+
+// pieceAvailability is how many peers have each piece.
+func (t *TorrentSession) pieceAvailability() (counts []int) {
+	counts = make([]int, t.totalPieces)
+	for _, p := range t.peers {
+		if p.have == nil {
+			continue
+		}
+		for i := p.have.FindNextSet(0); i >= 0; i = p.have.FindNextSet(i + 1) {
+			counts[i]++
+		}
+	}
+	return
+}
+
+func (t *TorrentSession) trackerStatus() (s TrackerStatus) {
+	s.Announce = t.m.Announce
+	t.tracker.mu.Lock()
+	s.LastAnnounce, s.LastError = t.tracker.lastAnnounce, t.tracker.lastError
+	t.tracker.mu.Unlock()
+	if t.ti != nil {
+		s.Seeders, s.Leechers, s.Interval = t.ti.Complete, t.ti.Incomplete, int(t.ti.Interval)
+	}
+	return
+}
+
+func (t *TorrentSession) fileStatus() (files []FileStatus) {
+	paths, err := torrentFilePaths(&t.m.Info)
+	for i, f := range torrentFiles(&t.m.Info) {
+		s := FileStatus{Index: i, Length: f.Length, Priority: t.filePriority(i)}
+		if err == nil {
+			s.Path = paths[i]
+		}
+		files = append(files, s)
+	}
+	return
+}
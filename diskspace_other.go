@@ -0,0 +1,19 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errFreeSpaceUnsupported = errors.New("Free space check not supported.")
+
+func freeSpace(dir string) (free int64, err error) {
+	return 0, errFreeSpaceUnsupported
+}
+
+func allocatedSize(fi os.FileInfo) int64 {
+	return fi.Size()
+}
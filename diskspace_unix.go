@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errFreeSpaceUnsupported = errors.New("Free space check not supported.")
+
+func freeSpace(dir string) (free int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// allocatedSize is how much disk space a file already uses, which is less
+// than its size if it is sparse.
+func allocatedSize(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
@@ -0,0 +1,66 @@
+package main
+
+// The extension protocol handshake, used to learn how many outstanding
+// requests a peer will queue for us. Reference:
+// http://bittorrent.org/beps/bep_0010.html
+
+import (
+	"bytes"
+	"errors"
+
+	bencode "code.google.com/p/bencode-go"
+)
+
+const EXTENDED = 20
+
+// Reserved header bit that says a peer speaks the extension protocol.
+const (
+	extensionByte = 5 // Counted from the start of the reserved bytes.
+	extensionBit  = 0x10
+)
+
+func supportsExtensions(reserved []byte) bool {
+	return reserved[extensionByte]&extensionBit != 0
+}
+
+// sendExtensionHandshake tells the peer how many requests we queue. We don't
+// support any extension messages, so "m" is empty.
+func (p *peerState) sendExtensionHandshake() {
+	var b bytes.Buffer
+	b.WriteByte(EXTENDED)
+	b.WriteByte(0)
+	err := bencode.Marshal(&b, map[string]interface{}{
+		"m":    map[string]interface{}{},
+		"reqq": int64(MAX_PEER_REQUESTS),
+		"v":    "Taipei-Torrent",
+	})
+	if err != nil {
+		return
+	}
+	p.sendMessage(b.Bytes())
+}
+
+func (t *TorrentSession) doExtendedMessage(p *peerState, message []byte) (err error) {
+	if len(message) < 2 {
+		return errors.New("Unexpected length")
+	}
+	if message[1] != 0 {
+		// We didn't offer any extension messages, so ignore them.
+		return
+	}
+	v, err := bencode.Decode(bytes.NewReader(message[2:]))
+	if err != nil {
+		return errors.New("Bad extension handshake: " + err.Error())
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("Bad extension handshake")
+	}
+	if reqq, ok := dict["reqq"].(int64); ok && reqq > 0 {
+		p.reqq = int(reqq)
+		if p.maxRequests > p.reqq {
+			p.maxRequests = p.reqq
+		}
+	}
+	return
+}
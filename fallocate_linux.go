@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(fd *os.File, length int64) (err error) {
+	if length == 0 {
+		return
+	}
+	err = syscall.Fallocate(int(fd.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		// Some file systems can't do it. Fall back to writing zeros.
+		err = errFallocateUnsupported
+	}
+	return
+}
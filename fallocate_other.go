@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+func fallocate(fd *os.File, length int64) error {
+	return errFallocateUnsupported
+}
@@ -2,12 +2,35 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"io"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// How disk space is allocated for the files of a torrent.
+const (
+	ALLOCATE_SPARSE = "sparse" // Sparse files. Space is used as pieces arrive.
+	ALLOCATE_FULL   = "full"   // Reserve all the space up front, with fallocate where we can.
+	ALLOCATE_ZERO   = "zero"   // Write zeros over the whole file up front.
+)
+
+var allocation string
+var skipFiles string
+
+var errFallocateUnsupported = errors.New("fallocate not supported.")
+
+func init() {
+	flag.StringVar(&allocation, "allocate", ALLOCATE_SPARSE, "How to allocate disk space for torrent files: "+
+		"sparse, full (preallocate, and check there's enough free space before starting) or zero (write zeros).")
+	flag.StringVar(&skipFiles, "skipFiles", "", "Comma separated numbers of files in the torrent not to download, "+
+		"counting from 0.")
+}
+
 type FileStore interface {
 	io.ReaderAt
 	io.WriterAt
@@ -17,16 +40,45 @@ type FileStore interface {
 type fileEntry struct {
 	length int64
 	fd     *os.File
+	name   string // Empty for skipped files
+	// Opened read only, and the file doesn't exist. Reads as zeros.
+	missing bool
+	// A skipped file is never created. The bytes at its edges that share a
+	// piece with its neighbours are kept in the parts file instead: the first
+	// head bytes at partsOffset, the last tail bytes right after them.
+	parts       *os.File
+	partsOffset int64
+	head, tail  int64
+	writes      int64 // Counted atomically, so Relocate knows what to copy again
 }
 
 type fileStore struct {
-	offsets []int64
-	files   []fileEntry // Stored in increasing globalOffset order
+	offsets   []int64
+	files     []fileEntry // Stored in increasing globalOffset order
+	parts     *os.File    // Edges of skipped files, nil if there are none
+	partsName string
+	// The file of a single file torrent, or the directory holding the files
+	// of a multi-file torrent. Relocate moves it.
+	root string
+	// Held for reading by readers and writers, for writing while the files
+	// are being closed, moved and opened again.
+	mu     sync.RWMutex
+	moving sync.Mutex // Held for the whole of a Relocate
+}
+
+type FileStoreOptions struct {
+	Allocation string // One of the ALLOCATE_ modes
+	Skip       []bool // Files not to download, in torrentFiles order. May be nil.
+	// Open existing files read only and create nothing. Allocation and Skip
+	// are ignored.
+	ReadOnly bool
 }
 
-func (fe *fileEntry) open(name string, length int64) (err error) {
+func (fe *fileEntry) open(name string, length int64, mode string) (err error) {
 	fe.length = length
+	fe.name = name
 	st, err := os.Stat(name)
+	var size int64
 	if err != nil && os.IsNotExist(err) {
 		fe.fd, err = os.Create(name)
 		if err != nil {
@@ -34,14 +86,130 @@ func (fe *fileEntry) open(name string, length int64) (err error) {
 		}
 	} else {
 		fe.fd, err = os.OpenFile(name, os.O_RDWR, 0600)
-		if st.Size() == length {
+		if err != nil {
+			return
+		}
+		size = st.Size()
+		if size == length && mode == ALLOCATE_SPARSE {
 			return
 		}
 	}
-	err = os.Truncate(name, length)
+	switch mode {
+	case ALLOCATE_FULL:
+		if err = fallocate(fe.fd, length); err == errFallocateUnsupported {
+			err = zeroFill(fe.fd, size, length)
+		}
+	case ALLOCATE_ZERO:
+		// Only the part past the current end. Holes in an existing file may
+		// hide data we downloaded earlier.
+		err = zeroFill(fe.fd, size, length)
+	}
 	if err != nil {
-		return
-		err = errors.New("Could not truncate file.")
+		return errors.New("Could not allocate " + name + ": " + err.Error())
+	}
+	if size != length {
+		err = os.Truncate(name, length)
+	}
+	return
+}
+
+func (fe *fileEntry) openReadOnly(name string, length int64) (err error) {
+	fe.length = length
+	fe.name = name
+	fe.fd, err = os.Open(name)
+	if err != nil && os.IsNotExist(err) {
+		fe.missing, err = true, nil
+	}
+	return
+}
+
+func (fe *fileEntry) readAt(p []byte, off int64) (n int, err error) {
+	if fe.missing {
+		for i, _ := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	if fe.parts == nil {
+		return fe.fd.ReadAt(p, off)
+	}
+	for len(p) > 0 && err == nil {
+		partsOff, chunk := fe.partsRange(off, int64(len(p)))
+		var nThisTime int
+		if partsOff < 0 {
+			// We don't keep the middle of a skipped file.
+			for i := int64(0); i < chunk; i++ {
+				p[i] = 0
+			}
+			nThisTime = int(chunk)
+		} else {
+			nThisTime, err = fe.parts.ReadAt(p[:chunk], partsOff)
+			if err == io.EOF {
+				// Not written yet.
+				for i := int64(nThisTime); i < chunk; i++ {
+					p[i] = 0
+				}
+				nThisTime, err = int(chunk), nil
+			}
+		}
+		n += nThisTime
+		p = p[nThisTime:]
+		off += int64(nThisTime)
+	}
+	return
+}
+
+func (fe *fileEntry) writeAt(p []byte, off int64) (n int, err error) {
+	if fe.missing {
+		return 0, errors.New("Can't write to " + fe.name + ": the store is read only.")
+	}
+	atomic.AddInt64(&fe.writes, 1)
+	if fe.parts == nil {
+		return fe.fd.WriteAt(p, off)
+	}
+	for len(p) > 0 && err == nil {
+		partsOff, chunk := fe.partsRange(off, int64(len(p)))
+		nThisTime := int(chunk)
+		if partsOff >= 0 {
+			nThisTime, err = fe.parts.WriteAt(p[:chunk], partsOff)
+		}
+		n += nThisTime
+		p = p[nThisTime:]
+		off += int64(nThisTime)
+	}
+	return
+}
+
+// partsRange maps off in a skipped file to an offset in the parts file, or
+// -1 if that byte isn't kept. chunk is how many bytes from off, up to max,
+// map the same way.
+func (fe *fileEntry) partsRange(off, max int64) (partsOff, chunk int64) {
+	tailStart := fe.length - fe.tail
+	switch {
+	case off < fe.head:
+		partsOff, chunk = fe.partsOffset+off, fe.head-off
+	case off < tailStart:
+		partsOff, chunk = -1, tailStart-off
+	default:
+		partsOff, chunk = fe.partsOffset+fe.head+off-tailStart, fe.length-off
+	}
+	if chunk > max {
+		chunk = max
+	}
+	return
+}
+
+// zeroFill writes zeros from start up to end.
+func zeroFill(fd *os.File, start, end int64) (err error) {
+	zeros := make([]byte, 1024*1024)
+	for off := start; off < end; off += int64(len(zeros)) {
+		chunk := zeros
+		if end-off < int64(len(chunk)) {
+			chunk = chunk[:end-off]
+		}
+		if _, err = fd.WriteAt(chunk, off); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -64,34 +232,161 @@ func ensureDirectory(fullPath string) (err error) {
 	return
 }
 
+// torrentFiles lists the files of a torrent. Single file torrents get a
+// dummy list with one entry.
+func torrentFiles(info *InfoDict) []FileDict {
+	if len(info.Files) == 0 {
+		return []FileDict{FileDict{Length: info.Length, Path: []string{info.Name}, Md5sum: info.Md5sum}}
+	}
+	return info.Files
+}
+
+// NewFileStore stores a torrent as files under storePath, allocated as the
+// -allocate flag says, leaving out the files in -skipFiles.
 func NewFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+	skip, err := parseSkipFiles(skipFiles, len(torrentFiles(info)))
+	if err != nil {
+		return
+	}
+	return NewFileStoreWithOptions(info, storePath, FileStoreOptions{Allocation: allocation, Skip: skip})
+}
+
+func NewFileStoreWithOptions(info *InfoDict, storePath string, opts FileStoreOptions) (f FileStore, totalSize int64, err error) {
+	mode := opts.Allocation
+	if mode != ALLOCATE_SPARSE && mode != ALLOCATE_FULL && mode != ALLOCATE_ZERO && !opts.ReadOnly {
+		err = errors.New("Unknown allocation mode " + mode)
+		return
+	}
+	name, err := torrentName(info)
+	if err != nil {
+		return
+	}
+	relPaths, err := torrentFilePaths(info)
+	if err != nil {
+		return
+	}
 	fs := new(fileStore)
-	numFiles := len(info.Files)
-	if numFiles == 0 {
-		// Create dummy Files structure.
-		info = &InfoDict{Files: []FileDict{FileDict{info.Length, []string{info.Name}, info.Md5sum}}}
-		numFiles = 1
+	fs.root = storePath
+	if len(info.Files) == 0 {
+		fs.root = path.Join(storePath, name)
 	}
+	files := torrentFiles(info)
+	numFiles := len(files)
 	fs.files = make([]fileEntry, numFiles)
 	fs.offsets = make([]int64, numFiles)
-	for i, _ := range info.Files {
-		src := &info.Files[i]
-		fullPath := path.Join(storePath, path.Clean(path.Join(src.Path...)))
+	paths := make([]string, numFiles)
+	var needed int64
+	for i, _ := range files {
+		fs.offsets[i] = totalSize
+		totalSize += files[i].Length
+		if i < len(opts.Skip) && opts.Skip[i] && !opts.ReadOnly {
+			continue
+		}
+		paths[i] = path.Join(storePath, relPaths[i])
+		if len(paths[i]) > MAX_PATH_LENGTH {
+			err = errors.New("Path too long: " + paths[i])
+			return
+		}
+		needed += files[i].Length
+		if st, err := os.Stat(paths[i]); err == nil {
+			needed -= allocatedSize(st)
+		}
+	}
+	if opts.ReadOnly {
+		for i, _ := range files {
+			if err = fs.files[i].openReadOnly(paths[i], files[i].Length); err != nil {
+				fs.Close()
+				return
+			}
+		}
+		f = fs
+		return
+	}
+	if mode != ALLOCATE_SPARSE && needed > 0 {
+		if err = checkFreeSpace(storePath, needed); err != nil {
+			return
+		}
+	}
+	for i, _ := range files {
+		src := &files[i]
+		fullPath := paths[i]
+		if fullPath == "" {
+			if err = fs.skip(i, info, path.Join(storePath, "."+name+".parts")); err != nil {
+				fs.Close()
+				return
+			}
+			continue
+		}
 		err = ensureDirectory(fullPath)
 		if err != nil {
+			fs.Close()
 			return
 		}
-		err = fs.files[i].open(fullPath, src.Length)
+		err = fs.files[i].open(fullPath, src.Length, mode)
 		if err != nil {
+			fs.Close()
 			return
 		}
-		fs.offsets[i] = totalSize
-		totalSize += src.Length
 	}
 	f = fs
 	return
 }
 
+// skip sets up file i to keep only its edges, in the parts file.
+func (fs *fileStore) skip(i int, info *InfoDict, partsName string) (err error) {
+	fe := &fs.files[i]
+	fe.length = torrentFiles(info)[i].Length
+	start, end := fs.offsets[i], fs.offsets[i]+fe.length
+	pieceLength := info.PieceLength
+	// Bytes up to the first piece boundary in the file, and after the last.
+	fe.head = (pieceLength - start%pieceLength) % pieceLength
+	if fe.head > fe.length {
+		fe.head = fe.length
+	}
+	if end%pieceLength <= fe.length-fe.head {
+		fe.tail = end % pieceLength
+	}
+	if fs.parts == nil {
+		fs.partsName = partsName
+		if err = ensureDirectory(fs.partsName); err != nil {
+			return
+		}
+		if fs.parts, err = os.OpenFile(fs.partsName, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+			return
+		}
+	}
+	fe.parts = fs.parts
+	for j := 0; j < i; j++ {
+		if other := &fs.files[j]; other.parts != nil {
+			fe.partsOffset += other.head + other.tail
+		}
+	}
+	return
+}
+
+// checkFreeSpace fails if the file system holding dir has less than needed
+// bytes free. dir doesn't have to exist yet.
+func checkFreeSpace(dir string, needed int64) (err error) {
+	for {
+		if _, err = os.Stat(dir); err == nil || dir == "." || dir == "/" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	if err == errFreeSpaceUnsupported {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	if free < needed {
+		return errors.New("Not enough disk space in " + dir + ": need " +
+			strconv.FormatInt(needed, 10) + " bytes, have " + strconv.FormatInt(free, 10) + ".")
+	}
+	return
+}
+
 func (f *fileStore) find(offset int64) int {
 	// Binary search
 	offsets := f.offsets
@@ -110,6 +405,12 @@ func (f *fileStore) find(offset int64) int {
 }
 
 func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.readAt(p, off)
+}
+
+func (f *fileStore) readAt(p []byte, off int64) (n int, err error) {
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -120,9 +421,8 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.ReadAt(p[0:chunk], itemOffset)
+			nThisTime, err = entry.readAt(p[0:chunk], itemOffset)
 			n = n + nThisTime
 			if err != nil {
 				return
@@ -141,6 +441,12 @@ func (f *fileStore) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.writeAt(p, off)
+}
+
+func (f *fileStore) writeAt(p []byte, off int64) (n int, err error) {
 	index := f.find(off)
 	for len(p) > 0 && index < len(f.offsets) {
 		chunk := int64(len(p))
@@ -151,9 +457,8 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 			if space < chunk {
 				chunk = space
 			}
-			fd := entry.fd
 			var nThisTime int
-			nThisTime, err = fd.WriteAt(p[0:chunk], itemOffset)
+			nThisTime, err = entry.writeAt(p[0:chunk], itemOffset)
 			n += nThisTime
 			if err != nil {
 				return
@@ -178,6 +483,13 @@ func (f *fileStore) WriteAt(p []byte, off int64) (n int, err error) {
 }
 
 func (f *fileStore) Close() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeFiles()
+	return
+}
+
+func (f *fileStore) closeFiles() {
 	for i, _ := range f.files {
 		fd := f.files[i].fd
 		if fd != nil {
@@ -185,5 +497,26 @@ func (f *fileStore) Close() (err error) {
 			f.files[i].fd = nil
 		}
 	}
+	if f.parts != nil {
+		f.parts.Close()
+		f.parts = nil
+	}
+}
+
+// parseSkipFiles parses a comma separated list of file numbers, counting
+// from 0 in the order the torrent lists them.
+func parseSkipFiles(s string, numFiles int) (skip []bool, err error) {
+	if s == "" {
+		return
+	}
+	skip = make([]bool, numFiles)
+	for _, field := range strings.Split(s, ",") {
+		var i int
+		i, err = strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || i < 0 || i >= numFiles {
+			return nil, errors.New("Bad file number " + field + " in -skipFiles.")
+		}
+		skip[i] = true
+	}
 	return
 }
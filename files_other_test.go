@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// allocatedBytes can't tell how much disk space a file takes up here.
+func allocatedBytes(fi os.FileInfo) (n int64, ok bool) {
+	return
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"crypto/sha1"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
+	"runtime"
 	"testing"
 )
 
@@ -32,8 +35,8 @@ func mkFileStore(tf testFile) (fs *fileStore, err error) {
 	if err != nil {
 		return fs, err
 	}
-	f := fileEntry{tf.fileLen, fd}
-	return &fileStore{[]int64{0}, []fileEntry{f}}, nil
+	f := fileEntry{length: tf.fileLen, fd: fd}
+	return &fileStore{offsets: []int64{0}, files: []fileEntry{f}}, nil
 }
 
 func TestFileStoreRead(t *testing.T) {
@@ -55,3 +58,90 @@ func TestFileStoreRead(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreAllocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := &InfoDict{PieceLength: 16, Name: "test", Length: 100000}
+	allocated := make(map[string]int64)
+	for _, mode := range []string{ALLOCATE_SPARSE, ALLOCATE_FULL, ALLOCATE_ZERO} {
+		storePath := path.Join(dir, mode)
+		fs, totalSize, err := NewFileStoreWithOptions(info, storePath, FileStoreOptions{Allocation: mode})
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		fs.Close()
+		st, err := os.Stat(path.Join(storePath, "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if totalSize != 100000 || st.Size() != 100000 {
+			t.Errorf("%s: wanted 100000 bytes, got %d on disk, total %d", mode, st.Size(), totalSize)
+		}
+		if n, ok := allocatedBytes(st); ok {
+			allocated[mode] = n
+			if mode != ALLOCATE_SPARSE && n < 100000 {
+				t.Errorf("%s: wanted 100000 bytes allocated, got %d", mode, n)
+			}
+		}
+	}
+	if n, ok := allocated[ALLOCATE_SPARSE]; ok && n >= allocated[ALLOCATE_FULL] {
+		t.Errorf("Sparse file has %d bytes allocated, as many as a full one", n)
+	}
+	if _, _, err = NewFileStoreWithOptions(info, dir, FileStoreOptions{Allocation: "lazy"}); err == nil {
+		t.Errorf("Unknown allocation mode should fail")
+	}
+	if err = checkFreeSpace(path.Join(dir, "not", "there"), 1<<62); err == nil && runtime.GOOS != "windows" {
+		t.Errorf("checkFreeSpace should fail for an impossibly large torrent")
+	}
+}
+
+func TestFileStoreSkippedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Pieces are [0,16) [16,32) [32,48). "b" covers [10,40): its first 6 bytes
+	// share a piece with "a", its last 8 bytes share one with "c".
+	info := &InfoDict{PieceLength: 16, Name: "test", Files: []FileDict{
+		{Length: 10, Path: []string{"a"}},
+		{Length: 30, Path: []string{"b"}},
+		{Length: 8, Path: []string{"c"}},
+	}}
+	fs, _, err := NewFileStoreWithOptions(info, dir, FileStoreOptions{Allocation: ALLOCATE_SPARSE, Skip: []bool{false, true, false}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	data := make([]byte, 48)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	if _, err = fs.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Errorf("Skipped file should not exist, stat says %v", err)
+	}
+	got := make([]byte, 48)
+	if _, err = fs.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		want := data[i]
+		if i >= 16 && i < 32 {
+			// Only in the skipped file, so not kept.
+			want = 0
+		}
+		if got[i] != want {
+			t.Errorf("Byte %d: wanted %d, got %d", i, want, got[i])
+		}
+	}
+	if st, err := os.Stat(path.Join(dir, ".test.parts")); err != nil || st.Size() != 14 {
+		t.Errorf("Parts file should hold 14 bytes: %v %v", st, err)
+	}
+}
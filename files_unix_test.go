@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedBytes returns how much disk space a file takes up.
+func allocatedBytes(fi os.FileInfo) (n int64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return int64(st.Blocks) * 512, true
+}
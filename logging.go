@@ -0,0 +1,248 @@
+package main
+
+// Leveled logging with fields. Each subsystem has a logger with its own
+// verbosity, set with -logLevel or through the API while running. Lines are
+// text by default, or one JSON object each with -logJSON.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var logLevelSpec string
+var logJSON bool
+
+func init() {
+	flag.StringVar(&logLevelSpec, "logLevel", "info", "Log level: debug, info, warn or error. Set it per subsystem "+
+		"with a list like info,peer=debug,tracker=warn. The subsystems are api, dht, peer, picker, session, "+
+		"storage, tracker and upnp.")
+	flag.BoolVar(&logJSON, "logJSON", false, "Log one JSON object per line, with time, level, subsystem, msg "+
+		"and the fields of the message.")
+}
+
+type logLevel int32
+
+const (
+	LOG_DEBUG logLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (level logLevel, err error) {
+	for i, name := range logLevelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, errors.New("Unknown log level " + s + ".")
+}
+
+// The level of each subsystem, read and set atomically.
+var subsystemLevels = make(map[string]*int32)
+
+var (
+	apiLog     = newLogger("api")
+	dhtLog     = newLogger("dht")
+	peerLog    = newLogger("peer")    // Connections and the peer wire protocol
+	pickerLog  = newLogger("picker")  // What we request, and from whom
+	sessionLog = newLogger("session") // Starting, stopping, seeding
+	storageLog = newLogger("storage") // Files, the disk cache, checking pieces
+	trackerLog = newLogger("tracker")
+	upnpLog    = newLogger("upnp")
+)
+
+type logger struct {
+	subsystem string
+	level     *int32
+	fields    []interface{} // Key, value pairs added to each line
+}
+
+func newLogger(subsystem string) *logger {
+	level := int32(LOG_INFO)
+	subsystemLevels[subsystem] = &level
+	return &logger{subsystem: subsystem, level: &level}
+}
+
+// setLogLevels applies a -logLevel list. A level without a subsystem is for
+// the subsystems the list doesn't name.
+func setLogLevels(spec string) (err error) {
+	levels := make(map[string]logLevel)
+	other := LOG_INFO
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		subsystem, name := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			subsystem, name = item[:i], item[i+1:]
+		}
+		var level logLevel
+		if level, err = parseLogLevel(name); err != nil {
+			return
+		}
+		if subsystem == "" {
+			other = level
+		} else if _, ok := subsystemLevels[subsystem]; ok {
+			levels[subsystem] = level
+		} else {
+			return errors.New("Unknown log subsystem " + subsystem + ".")
+		}
+	}
+	for subsystem, p := range subsystemLevels {
+		level, ok := levels[subsystem]
+		if !ok {
+			level = other
+		}
+		atomic.StoreInt32(p, int32(level))
+	}
+	return
+}
+
+// logLevels lists the level of each subsystem, in the form setLogLevels
+// takes.
+func logLevels() string {
+	var items []string
+	for _, subsystem := range logSubsystems() {
+		items = append(items, subsystem+"="+logLevel(atomic.LoadInt32(subsystemLevels[subsystem])).String())
+	}
+	return strings.Join(items, ",")
+}
+
+// With returns a logger that adds the key, value pairs to each line.
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{l.subsystem, l.level, fields}
+}
+
+// Enabled lets hot paths skip building lines nobody will see.
+func (l *logger) Enabled(level logLevel) bool {
+	return logLevel(atomic.LoadInt32(l.level)) <= level
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.output(LOG_DEBUG, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.output(LOG_INFO, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.output(LOG_WARN, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.output(LOG_ERROR, msg, kv) }
+
+// Fatal logs at the error level whatever the verbosity, and exits.
+func (l *logger) Fatal(msg string, kv ...interface{}) {
+	l.write(LOG_ERROR, msg, kv)
+	os.Exit(1)
+}
+
+func (l *logger) output(level logLevel, msg string, kv []interface{}) {
+	if l.Enabled(level) {
+		l.write(level, msg, kv)
+	}
+}
+
+// JSON lines bypass the log package's prefix, so they need their own lock.
+var logMu sync.Mutex
+
+func (l *logger) write(level logLevel, msg string, kv []interface{}) {
+	fields := append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields[:len(fields)-1], "value", fields[len(fields)-1])
+	}
+	if logJSON {
+		line := formatJSONLine(time.Now(), level, l.subsystem, msg, fields)
+		logMu.Lock()
+		log.Writer().Write(line)
+		logMu.Unlock()
+		return
+	}
+	log.Output(4, formatTextLine(level, l.subsystem, msg, fields))
+}
+
+// logValue turns errors and Stringers, like durations and addresses, into
+// their text.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func formatTextLine(level logLevel, subsystem, msg string, fields []interface{}) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%-5s %s: %s", strings.ToUpper(level.String()), subsystem, msg)
+	for i := 0; i < len(fields); i += 2 {
+		s := fmt.Sprint(logValue(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], s)
+	}
+	return b.String()
+}
+
+func formatJSONLine(now time.Time, level logLevel, subsystem, msg string, fields []interface{}) []byte {
+	var b bytes.Buffer
+	add := func(key string, value interface{}) {
+		if b.Len() == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	add("time", now.Format(time.RFC3339Nano))
+	add("level", level.String())
+	add("subsystem", subsystem)
+	add("msg", msg)
+	for i := 0; i < len(fields); i += 2 {
+		add(fmt.Sprint(fields[i]), logValue(fields[i+1]))
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// logger returns l with the session's info hash added, once it is known.
+func (t *TorrentSession) logger(l *logger) *logger {
+	if t.m == nil {
+		return l
+	}
+	return l.With("infohash", fmt.Sprintf("%x", t.m.InfoHash))
+}
+
+// logSubsystems returns the names of the subsystems, sorted.
+func logSubsystems() (names []string) {
+	for subsystem := range subsystemLevels {
+		names = append(names, subsystem)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetLogLevels(t *testing.T) {
+	defer setLogLevels("info")
+	if err := setLogLevels("warn, peer=debug,tracker=error"); err != nil {
+		t.Fatal(err)
+	}
+	if !peerLog.Enabled(LOG_DEBUG) || trackerLog.Enabled(LOG_WARN) || dhtLog.Enabled(LOG_INFO) ||
+		!dhtLog.Enabled(LOG_WARN) {
+		t.Errorf("Levels are %s", logLevels())
+	}
+	if got := logLevels(); !strings.Contains(got, "dht=warn,peer=debug,") || !strings.Contains(got, "tracker=error") {
+		t.Errorf("Levels are %s", got)
+	}
+	// Derived loggers follow their subsystem.
+	l := peerLog.With("peer", "x")
+	setLogLevels("")
+	if l.Enabled(LOG_DEBUG) || !l.Enabled(LOG_INFO) {
+		t.Errorf("Derived logger didn't follow the level")
+	}
+	for _, bad := range []string{"loud", "peer=loud", "nosuch=debug"} {
+		if err := setLogLevels(bad); err == nil {
+			t.Errorf("Accepted %q", bad)
+		}
+	}
+}
+
+func TestLogLines(t *testing.T) {
+	fields := []interface{}{"peer", "1.2.3.4:5", "err", errors.New("broken pipe"), "took", 1500 * time.Millisecond,
+		"n", 3}
+	text := formatTextLine(LOG_WARN, "peer", "Closing peer", fields)
+	if want := `WARN  peer: Closing peer peer=1.2.3.4:5 err="broken pipe" took=1.5s n=3`; text != want {
+		t.Errorf("Got  %s\nwant %s", text, want)
+	}
+
+	now := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	line := formatJSONLine(now, LOG_INFO, "tracker", "Announcing", fields)
+	var v map[string]interface{}
+	if err := json.Unmarshal(line, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["time"] != "2014-01-02T03:04:05Z" || v["level"] != "info" || v["subsystem"] != "tracker" ||
+		v["msg"] != "Announcing" || v["err"] != "broken pipe" || v["took"] != "1.5s" || v["n"] != 3.0 {
+		t.Errorf("Got %s", line)
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	var b bytes.Buffer
+	oldOutput, oldFlags := log.Writer(), log.Flags()
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(oldOutput)
+		log.SetFlags(oldFlags)
+	}()
+
+	session := storageLog.With("infohash", "ab")
+	session.Info("One", "piece", 1)
+	// An odd field is kept, and doesn't change the parent's fields.
+	session.With("extra").Info("Two")
+	session.Debug("Hidden")
+	session.Info("Three")
+	want := "INFO  storage: One infohash=ab piece=1\n" +
+		"INFO  storage: Two infohash=ab value=extra\n" +
+		"INFO  storage: Three infohash=ab\n"
+	if b.String() != want {
+		t.Errorf("Got\n%swant\n%s", b.String(), want)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 var torrent string
@@ -13,8 +16,12 @@ func main() {
 	flag.Parse()
 
 	args := flag.Args()
+	if len(args) > 0 && args[0] == "verify" {
+		verifyMain(args[1:])
+		return
+	}
 	narg := flag.NArg()
-	if narg != 1 {
+	if narg > 1 || (narg < 1 && apiAddr == "") {
 		if narg < 1 {
 			log.Println("Too few arguments. Torrent file or torrent URL required.")
 		} else {
@@ -23,24 +30,95 @@ func main() {
 		usage()
 	}
 
-	torrent = args[0]
+	if err := setLogLevels(logLevelSpec); err != nil {
+		log.Println("Bad -logLevel:", err)
+		return
+	}
+	if err := initProxy(); err != nil {
+		sessionLog.Error("Bad proxy configuration", "err", err)
+		return
+	}
+	if err := initRateLimits(); err != nil {
+		sessionLog.Error("Bad rate limit configuration", "err", err)
+		return
+	}
+	if err := initSeeding(); err != nil {
+		sessionLog.Error("Bad seeding configuration", "err", err)
+		return
+	}
+	if err := initBlocklist(); err != nil {
+		peerLog.Error("Could not load blocklist", "err", err)
+		return
+	}
 
-	log.Println("Starting.")
-	ts, err := NewTorrentSession(torrent)
+	newStore, err := storageFromFlags()
 	if err != nil {
-		log.Println("Could not create torrent session.", err)
+		storageLog.Error("Bad storage configuration", "err", err)
 		return
 	}
-	err = ts.DoTorrent()
-	if err != nil {
-		log.Println("Failed: ", err)
+
+	sessionLog.Info("Starting")
+	sessions := newSessionManager(newStore)
+	if storageFlag == "blob" {
+		sessions.maxSessions = 1
+	}
+	if narg == 1 {
+		torrent = args[0]
+		if _, err = sessions.Add(torrent); err != nil {
+			sessionLog.Error("Could not create torrent session", "torrent", torrent, "err", err)
+			return
+		}
+	}
+	quit := make(chan bool, 2)
+	if apiAddr != "" {
+		if err = serveAPI(apiAddr, sessions); err != nil {
+			apiLog.Error("Could not start the API server", "err", err)
+			return
+		}
 	} else {
-		log.Println("Done")
+		// Without the API nothing can be added, so we are done once the
+		// session is.
+		go func() {
+			sessions.Wait()
+			quit <- true
+		}()
 	}
+
+	var stopping sync.Once
+	shutdown := func() {
+		stopping.Do(func() {
+			sessions.StopAll()
+			sessions.Wait()
+			quit <- true
+		})
+	}
+	restoreTerminal := func() {}
+	if useTUI {
+		if stopTUI, err := startTUI(sessions, shutdown); err != nil {
+			sessionLog.Warn("No status display", "err", err)
+		} else {
+			restoreTerminal = stopTUI
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		sessionLog.Info("Shutting down. Interrupt again to quit at once.")
+		go shutdown()
+		<-stop
+		restoreTerminal()
+		os.Exit(1)
+	}()
+	<-quit
+	restoreTerminal()
 }
 
 func usage() {
 	log.Printf("usage: Taipei-Torrent [options] (torrent-file | torrent-url)")
+	log.Printf("       Taipei-Torrent -apiAddr=host:port [options] [torrent-file | torrent-url]")
+	log.Printf("       Taipei-Torrent [options] verify (torrent-file | torrent-url)")
 
 	flag.PrintDefaults()
 	os.Exit(2)
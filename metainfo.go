@@ -6,7 +6,6 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"strings"
 	"time"
@@ -15,9 +14,10 @@ import (
 )
 
 type FileDict struct {
-	Length int64
-	Path   []string
-	Md5sum string
+	Length   int64
+	Path     []string
+	PathUtf8 []string "path.utf-8"
+	Md5sum   string
 }
 
 type InfoDict struct {
@@ -25,6 +25,7 @@ type InfoDict struct {
 	Pieces      string
 	Private     int64
 	Name        string
+	NameUtf8    string "name.utf-8"
 	// Single File Mode
 	Length int64
 	Md5sum string
@@ -136,6 +137,9 @@ type SessionInfo struct {
 }
 
 func getTrackerInfo(url string) (tr *TrackerResponse, err error) {
+	if strings.HasPrefix(url, "udp://") {
+		return getUDPTrackerInfo(url)
+	}
 	r, err := proxyHttpGet(url)
 	if err != nil {
 		return
@@ -144,7 +148,7 @@ func getTrackerInfo(url string) (tr *TrackerResponse, err error) {
 	if r.StatusCode >= 400 {
 		data, _ := ioutil.ReadAll(r.Body)
 		reason := "Bad Request " + string(data)
-		log.Println(reason)
+		trackerLog.Debug("Tracker answered with an error", "status", r.StatusCode, "body", string(data))
 		err = errors.New(reason)
 		return
 	}
@@ -0,0 +1,234 @@
+package main
+
+// Prometheus metrics, at /metrics on the API server. Counters that only
+// the session's own goroutines can see are kept in sessionMetrics; the
+// rest is read from the session when scraped.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the latency histogram buckets.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	s := d.Seconds()
+	for i, le := range latencyBuckets {
+		if s <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// sessionMetrics are updated from the main goroutine, the announce
+// goroutines and the disk goroutines.
+type sessionMetrics struct {
+	mu               sync.Mutex
+	hashFailures     uint64
+	blocksReceived   uint64
+	blocksSent       uint64
+	announces        uint64
+	announceErrors   uint64
+	announceLatency  histogram
+	dhtRequests      uint64
+	dhtPeers         uint64 // Peers the DHT gave us
+	diskReadLatency  histogram
+	diskWriteLatency histogram
+}
+
+func (m *sessionMetrics) count(counter *uint64, n int) {
+	m.mu.Lock()
+	*counter += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *sessionMetrics) observe(h *histogram, d time.Duration) {
+	m.mu.Lock()
+	h.observe(d)
+	m.mu.Unlock()
+}
+
+func (m *sessionMetrics) announced(d time.Duration, failed bool) {
+	m.mu.Lock()
+	m.announces++
+	if failed {
+		m.announceErrors++
+	}
+	m.announceLatency.observe(d)
+	m.mu.Unlock()
+}
+
+type metricFamily struct {
+	name, typ, help string
+	lines           []string
+}
+
+// metricsWriter collects samples, and writes them grouped by name in the
+// Prometheus text format.
+type metricsWriter struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func (w *metricsWriter) family(name, typ, help string) *metricFamily {
+	if w.byName == nil {
+		w.byName = make(map[string]*metricFamily)
+	}
+	f, ok := w.byName[name]
+	if !ok {
+		f = &metricFamily{name: name, typ: typ, help: help}
+		w.byName[name] = f
+		w.families = append(w.families, f)
+	}
+	return f
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (w *metricsWriter) add(name, typ, help, labels string, value float64) {
+	f := w.family(name, typ, help)
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	f.lines = append(f.lines, name+" "+formatValue(value))
+}
+
+func (w *metricsWriter) addHistogram(name, help, labels string, h histogram) {
+	f := w.family(name, "histogram", help)
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		f.lines = append(f.lines, fmt.Sprintf("%s_bucket{%s,le=\"%s\"} %d", name, labels, formatValue(le), cumulative))
+	}
+	f.lines = append(f.lines, fmt.Sprintf("%s_bucket{%s,le=\"+Inf\"} %d", name, labels, h.count),
+		name+"_sum{"+labels+"} "+formatValue(h.sum),
+		fmt.Sprintf("%s_count{%s} %d", name, labels, h.count))
+}
+
+func (w *metricsWriter) WriteTo(out io.Writer) (n int64, err error) {
+	var b bytes.Buffer
+	for _, f := range w.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, l := range f.lines {
+			b.WriteString(l + "\n")
+		}
+	}
+	return b.WriteTo(out)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// writeMetrics adds a session's metrics. It must run on the session's main
+// goroutine, or after the session stopped.
+func (t *TorrentSession) writeMetrics(w *metricsWriter) {
+	name, _ := torrentName(&t.m.Info)
+	labels := label("infohash", fmt.Sprintf("%x", t.m.InfoHash)) + "," + label("name", name)
+
+	w.add("taipei_torrent_downloaded_bytes_total", "counter", "Piece data downloaded.", labels,
+		float64(t.si.Downloaded))
+	w.add("taipei_torrent_uploaded_bytes_total", "counter", "Piece data uploaded.", labels,
+		float64(t.si.Uploaded))
+	w.add("taipei_torrent_pieces_good", "gauge", "Pieces we have.", labels, float64(t.goodPieces))
+	w.add("taipei_torrent_pieces_total", "gauge", "Pieces in the torrent.", labels, float64(t.totalPieces))
+
+	sources := map[string]int{SOURCE_TRACKER: 0, SOURCE_DHT: 0, SOURCE_INCOMING: 0}
+	states := map[string]int{"am_choking": 0, "am_interested": 0, "peer_choking": 0, "peer_interested": 0}
+	for _, p := range t.peers {
+		sources[p.source]++
+		for state, on := range map[string]bool{"am_choking": p.am_choking, "am_interested": p.am_interested,
+			"peer_choking": p.peer_choking, "peer_interested": p.peer_interested} {
+			if on {
+				states[state]++
+			}
+		}
+	}
+	for _, source := range sortedKeys(sources) {
+		w.add("taipei_torrent_peers", "gauge", "Connected peers, by where we heard of them.",
+			labels+","+label("source", source), float64(sources[source]))
+	}
+	for _, state := range sortedKeys(states) {
+		w.add("taipei_torrent_peer_states", "gauge", "Connected peers in each choke and interest state.",
+			labels+","+label("state", state), float64(states[state]))
+	}
+
+	m := &t.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.add("taipei_torrent_hash_failures_total", "counter", "Pieces that failed their hash check.", labels,
+		float64(m.hashFailures))
+	w.add("taipei_torrent_blocks_received_total", "counter", "Blocks received from peers.", labels,
+		float64(m.blocksReceived))
+	w.add("taipei_torrent_blocks_sent_total", "counter", "Blocks sent to peers.", labels, float64(m.blocksSent))
+	w.add("taipei_torrent_tracker_announces_total", "counter", "Tracker announces.", labels, float64(m.announces))
+	w.add("taipei_torrent_tracker_announce_errors_total", "counter", "Tracker announces that failed.", labels,
+		float64(m.announceErrors))
+	w.addHistogram("taipei_torrent_tracker_announce_duration_seconds", "How long tracker announces took.",
+		labels, m.announceLatency)
+	w.add("taipei_torrent_dht_peer_requests_total", "counter", "DHT queries for peers.", labels,
+		float64(m.dhtRequests))
+	w.add("taipei_torrent_dht_peers_total", "counter", "Peers the DHT found.", labels, float64(m.dhtPeers))
+	w.addHistogram("taipei_torrent_disk_read_duration_seconds", "How long reading a block took.", labels,
+		m.diskReadLatency)
+	w.addHistogram("taipei_torrent_disk_write_duration_seconds", "How long a disk write or check took.",
+		labels, m.diskWriteLatency)
+}
+
+func sortedKeys(m map[string]int) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+type metricsServer struct {
+	sessions *sessionManager
+	token    string
+}
+
+func (s *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasToken(r, s.token) {
+		http.Error(w, "Bad or missing API token.", http.StatusUnauthorized)
+		return
+	}
+	var mw metricsWriter
+	for _, ms := range s.sessions.List() {
+		ts := ms.ts
+		ms.inspect(func() { ts.writeMetrics(&mw) })
+	}
+	connLimitsMu.Lock()
+	peers, halfOpen := globalPeers, globalHalfOpen
+	connLimitsMu.Unlock()
+	mw.add("taipei_torrent_connected_peers", "gauge", "Connected peers in all sessions.", "", float64(peers))
+	mw.add("taipei_torrent_half_open_connections", "gauge", "Dials in progress in all sessions.", "", float64(halfOpen))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw.WriteTo(w)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var w metricsWriter
+	w.add("a_total", "counter", "As.", label("x", `q"\`+"\n"), 1)
+	w.add("b", "gauge", "Bs.", "", 2.5)
+	w.add("a_total", "counter", "As.", label("x", "y"), 3)
+	var h histogram
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Minute)
+	w.addHistogram("c_seconds", "Cs.", label("x", "y"), h)
+	var b bytes.Buffer
+	w.WriteTo(&b)
+	out := b.String()
+	for _, want := range []string{
+		"# HELP a_total As.\n# TYPE a_total counter\na_total{x=\"q\\\"\\\\\\n\"} 1\na_total{x=\"y\"} 3\n",
+		"# TYPE b gauge\nb 2.5\n",
+		"c_seconds_bucket{x=\"y\",le=\"0.001\"} 0\nc_seconds_bucket{x=\"y\",le=\"0.005\"} 1\n",
+		"c_seconds_bucket{x=\"y\",le=\"30\"} 1\nc_seconds_bucket{x=\"y\",le=\"+Inf\"} 2\n",
+		"c_seconds_sum{x=\"y\"} 60.002\nc_seconds_count{x=\"y\"} 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	oldTrackerLessMode := trackerLessMode
+	trackerLessMode = true
+	defer func() { trackerLessMode = oldTrackerLessMode }()
+
+	sessions := newSessionManager(nil)
+	sessions.run = serveControl
+	ts := newControlledSession()
+	ts.metrics.count(&ts.metrics.hashFailures, 2)
+	if _, err := sessions.start(ts); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&metricsServer{sessions, "secret"})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %d without a token", resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL + "?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	labels := `infohash="3031323334353637383930313233343536373839",name="a"`
+	for _, want := range []string{
+		"taipei_torrent_hash_failures_total{" + labels + "} 2\n",
+		"taipei_torrent_pieces_total{" + labels + "} 7\n",
+		"taipei_torrent_peers{" + labels + `,source="incoming"} 0` + "\n",
+		"# TYPE taipei_torrent_connected_peers gauge\n",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("Missing %q in\n%s", want, b)
+		}
+	}
+	sessions.StopAll()
+	sessions.Wait()
+}
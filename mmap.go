@@ -0,0 +1,155 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// mmapFileStore lays files out on disk like fileStore, but reads and writes
+// them through memory maps, leaving caching to the kernel.
+type mmapFileStore struct {
+	*fileStore
+	maps [][]byte
+}
+
+// NewMmapFileStore is like NewFileStore, but never leaves files sparse.
+// Writing through a map to a hole on a full disk raises SIGBUS instead of
+// returning an error, so all the space is reserved up front.
+func NewMmapFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+	skip, err := parseSkipFiles(skipFiles, len(torrentFiles(info)))
+	if err != nil {
+		return
+	}
+	mode := allocation
+	if mode == ALLOCATE_SPARSE {
+		mode = ALLOCATE_FULL
+	}
+	store, totalSize, err := NewFileStoreWithOptions(info, storePath, FileStoreOptions{Allocation: mode, Skip: skip})
+	if err != nil {
+		return
+	}
+	fs := store.(*fileStore)
+	m := &mmapFileStore{fs, make([][]byte, len(fs.files))}
+	if err = m.mapFiles(); err != nil {
+		m.Close()
+		return
+	}
+	f = m
+	return
+}
+
+func (m *mmapFileStore) mapFiles() (err error) {
+	for i, entry := range m.files {
+		if entry.length == 0 || entry.parts != nil {
+			// Can't map an empty file, and there's nothing to map anyway.
+			// Skipped files only exist in the parts file.
+			continue
+		}
+		m.maps[i], err = syscall.Mmap(int(entry.fd.Fd()), 0, int(entry.length),
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return os.NewSyscallError("mmap", err)
+		}
+	}
+	return
+}
+
+func (m *mmapFileStore) unmapFiles() {
+	for i, data := range m.maps {
+		if data != nil {
+			syscall.Munmap(data)
+			m.maps[i] = nil
+		}
+	}
+}
+
+// Relocate moves the files like fileStore.Relocate, and maps them again.
+func (m *mmapFileStore) Relocate(dir string) (err error) {
+	closeFiles := func() {
+		m.unmapFiles()
+		m.closeFiles()
+	}
+	reopen := func() (err error) {
+		if err = m.reopen(); err == nil {
+			err = m.mapFiles()
+		}
+		return
+	}
+	return m.relocate(dir, closeFiles, reopen)
+}
+
+func (m *mmapFileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	index := m.find(off)
+	for len(p) > 0 && index < len(m.offsets) {
+		itemOffset := off - m.offsets[index]
+		if entry := &m.files[index]; itemOffset < entry.length {
+			var nThisTime int
+			if m.maps[index] != nil {
+				nThisTime = copy(p, m.maps[index][itemOffset:])
+			} else {
+				chunk := p
+				if int64(len(chunk)) > entry.length-itemOffset {
+					chunk = chunk[:entry.length-itemOffset]
+				}
+				if nThisTime, err = entry.readAt(chunk, itemOffset); err != nil {
+					return
+				}
+			}
+			n += nThisTime
+			p = p[nThisTime:]
+			off += int64(nThisTime)
+		}
+		index++
+	}
+	// Past the end of the store we read zeros, like fileStore.
+	for i, _ := range p {
+		p[i] = 0
+	}
+	n += len(p)
+	return
+}
+
+func (m *mmapFileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	index := m.find(off)
+	for len(p) > 0 && index < len(m.offsets) {
+		itemOffset := off - m.offsets[index]
+		if entry := &m.files[index]; itemOffset < entry.length {
+			var nThisTime int
+			if m.maps[index] != nil {
+				atomic.AddInt64(&entry.writes, 1)
+				nThisTime = copy(m.maps[index][itemOffset:], p)
+			} else {
+				chunk := p
+				if int64(len(chunk)) > entry.length-itemOffset {
+					chunk = chunk[:entry.length-itemOffset]
+				}
+				if nThisTime, err = entry.writeAt(chunk, itemOffset); err != nil {
+					return
+				}
+			}
+			n += nThisTime
+			p = p[nThisTime:]
+			off += int64(nThisTime)
+		}
+		index++
+	}
+	// Anything left over is past the end of the store.
+	rest, err := m.fileStore.writeAt(p, off)
+	n += rest
+	return
+}
+
+func (m *mmapFileStore) Close() (err error) {
+	m.mu.Lock()
+	m.unmapFiles()
+	m.mu.Unlock()
+	return m.fileStore.Close()
+}
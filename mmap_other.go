@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+func NewMmapFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+	err = errors.New("mmap storage is not supported on this platform.")
+	return
+}
@@ -6,7 +6,14 @@ import (
 	"time"
 )
 
-const MAX_OUR_REQUESTS = 2
+// How many blocks we keep requested from each peer. The actual number adapts
+// to the peer's throughput and latency, within these bounds.
+const MIN_OUR_REQUESTS = 2
+const MAX_OUR_REQUESTS = 250
+
+// We try to keep this much data in flight beyond one round trip.
+const REQUEST_QUEUE_TIME = 1 * time.Second
+
 const MAX_PEER_REQUESTS = 10
 const STANDARD_BLOCK_LENGTH = 16 * 1024
 
@@ -16,75 +23,109 @@ type peerMessage struct {
 }
 
 type peerState struct {
-	address         string
-	id              string
-	writeChan       chan []byte
-	writeChan2      chan []byte
-	lastWriteTime   time.Time
-	lastReadTime    time.Time
-	have            *Bitset // What the peer has told us it has
-	conn            net.Conn
-	am_choking      bool // this client is choking the peer
-	am_interested   bool // this client is interested in the peer
-	peer_choking    bool // peer is choking this client
-	peer_interested bool // peer is interested in this client
-	peer_requests   map[uint64]bool
-	our_requests    map[uint64]time.Time // What we requested, when we requested it
+	address          string
+	source           string // Where we heard of the peer, one of the SOURCE_ constants
+	id               string
+	writeChan        chan []byte
+	writeChan2       chan []byte // Messages other than piece data
+	pieceChan        chan []byte // Piece data, which is rate limited
+	lastWriteTime    time.Time
+	lastReadTime     time.Time
+	have             *Bitset // What the peer has told us it has
+	conn             net.Conn
+	am_choking       bool                 // this client is choking the peer
+	am_interested    bool                 // this client is interested in the peer
+	peer_choking     bool                 // peer is choking this client
+	peer_interested  bool                 // peer is interested in this client
+	peer_requests    map[uint64]bool      // Queued requests from the peer. True once a disk read is under way.
+	our_requests     map[uint64]time.Time // What we requested, when we requested it
+	uploadLimits     []*tokenBucket       // Piece data we send waits on these
+	downloadLimits   []*tokenBucket       // Piece data we receive waits on these
+	maxRequests      int                  // How many of our_requests to keep outstanding
+	reqq             int                  // The peer's request queue size from its extension handshake, 0 if unknown
+	minLatency       time.Duration        // Shortest time the peer took to answer a request recently
+	bytesReceived    int64                // Piece data received since the last updatePipeline
+	downloadRate     float64              // Bytes per second, smoothed
+	bytesSent        int64                // Piece data sent since the last updatePipeline
+	uploadRate       float64              // Bytes per second, smoothed
+	superSeedPiece   int                  // The piece we last offered the peer while super-seeding, or -1
+	superSeedOffered map[int]bool         // Every piece we offered the peer while super-seeding
+	log              *logger              // peerLog with the session and the peer's address
+	closed           bool
 }
 
-func queueingWriter(in, out chan []byte) {
-	queue := make(map[int][]byte)
-	head, tail := 0, 0
+// queueingWriter holds the messages sent on in until peerWriter takes them.
+// Piece data goes out on pieces and everything else on out, so protocol
+// messages don't wait behind the upload rate limit.
+func queueingWriter(in, out, pieces chan []byte) {
+	var control, data [][]byte
 L:
 	for {
-		if head == tail {
-			select {
-			case m, ok := <-in:
-				if !ok {
-					break L
-				}
-				queue[head] = m
-				head++
+		var outc, piecec chan []byte
+		var next, nextPiece []byte
+		if len(control) > 0 {
+			outc, next = out, control[0]
+		}
+		if len(data) > 0 {
+			piecec, nextPiece = pieces, data[0]
+		}
+		select {
+		case m, ok := <-in:
+			if !ok {
+				break L
 			}
-		} else {
-			select {
-			case m, ok := <-in:
-				if !ok {
-					break L
-				}
-				queue[head] = m
-				head++
-			case out <- queue[tail]:
-				delete(queue, tail)
-				tail++
+			if len(m) > 0 && m[0] == PIECE {
+				data = append(data, m)
+			} else {
+				control = append(control, m)
 			}
+		case outc <- next:
+			control[0] = nil
+			control = control[1:]
+		case piecec <- nextPiece:
+			data[0] = nil
+			data = data[1:]
 		}
 	}
 	// We throw away any messages waiting to be sent, including the
 	// nil message that is automatically sent when the in channel is closed
 	close(out)
+	close(pieces)
 }
 
 func NewPeerState(conn net.Conn) *peerState {
 	writeChan := make(chan []byte)
 	writeChan2 := make(chan []byte)
-	go queueingWriter(writeChan, writeChan2)
-	return &peerState{writeChan: writeChan, writeChan2: writeChan2, conn: conn,
+	pieceChan := make(chan []byte)
+	go queueingWriter(writeChan, writeChan2, pieceChan)
+	return &peerState{writeChan: writeChan, writeChan2: writeChan2, pieceChan: pieceChan, conn: conn,
 		am_choking: true, peer_choking: true,
 		peer_requests: make(map[uint64]bool, MAX_PEER_REQUESTS),
-		our_requests:  make(map[uint64]time.Time, MAX_OUR_REQUESTS)}
+		our_requests:  make(map[uint64]time.Time, MIN_OUR_REQUESTS),
+		maxRequests:   MIN_OUR_REQUESTS, superSeedPiece: -1, log: peerLog}
 }
 
 func (p *peerState) Close() {
+	if p.closed {
+		return
+	}
+	p.closed = true
 	p.conn.Close()
-	// No need to close p.writeChan. Further writes to p.conn will just fail.
+	// Lets queueingWriter and peerWriter exit.
+	close(p.writeChan)
 }
 
-func (p *peerState) AddRequest(index, begin, length uint32) {
-	if !p.am_choking && len(p.peer_requests) < MAX_PEER_REQUESTS {
-		offset := (uint64(index) << 32) | uint64(begin)
-		p.peer_requests[offset] = true
+// AddRequest queues a block the peer asked for. Returns false if we are
+// choking the peer, or it already has MAX_PEER_REQUESTS queued.
+func (p *peerState) AddRequest(index, begin, length uint32) bool {
+	if p.am_choking || len(p.peer_requests) >= MAX_PEER_REQUESTS {
+		return false
+	}
+	offset := (uint64(index) << 32) | uint64(begin)
+	if _, ok := p.peer_requests[offset]; !ok {
+		p.peer_requests[offset] = false
 	}
+	return true
 }
 
 func (p *peerState) CancelRequest(index, begin, length uint32) {
@@ -94,16 +135,51 @@ func (p *peerState) CancelRequest(index, begin, length uint32) {
 	}
 }
 
-func (p *peerState) RemoveRequest() (index, begin, length uint32, ok bool) {
-	for k, _ := range p.peer_requests {
-		index, begin = uint32(k>>32), uint32(k)
-		length = STANDARD_BLOCK_LENGTH
-		ok = true
-		return
+// RemoveRequest takes a request off the queue once its data has been read.
+// Returns false if the peer cancelled it or was choked in the meantime.
+func (p *peerState) RemoveRequest(index, begin uint32) (ok bool) {
+	offset := (uint64(index) << 32) | uint64(begin)
+	if _, ok = p.peer_requests[offset]; ok {
+		delete(p.peer_requests, offset)
 	}
 	return
 }
 
+// recordLatency notes how long the peer took to answer one of our requests.
+func (p *peerState) recordLatency(latency time.Duration) {
+	if p.minLatency == 0 || latency < p.minLatency {
+		p.minLatency = latency
+	}
+}
+
+// updatePipeline recomputes how many requests to keep outstanding, from the
+// bandwidth-delay product of the link to this peer, and updates the rates
+// the choker ranks peers by. Call it once per interval, with the length of
+// the interval.
+func (p *peerState) updatePipeline(interval time.Duration) {
+	rate := float64(p.bytesReceived) / interval.Seconds()
+	p.bytesReceived = 0
+	p.downloadRate = 0.8*p.downloadRate + 0.2*rate
+	p.uploadRate = 0.8*p.uploadRate + 0.2*float64(p.bytesSent)/interval.Seconds()
+	p.bytesSent = 0
+	// minLatency includes time spent in the peer's queue, so let it drift up
+	// again in case that queue has drained since.
+	p.minLatency += p.minLatency / 8
+	inFlight := p.downloadRate * (p.minLatency + REQUEST_QUEUE_TIME).Seconds()
+	n := int(inFlight/STANDARD_BLOCK_LENGTH) + 1
+	max := MAX_OUR_REQUESTS
+	if p.reqq > 0 && p.reqq < max {
+		max = p.reqq
+	}
+	if n < MIN_OUR_REQUESTS {
+		n = MIN_OUR_REQUESTS
+	}
+	if n > max {
+		n = max
+	}
+	p.maxRequests = n
+}
+
 func (p *peerState) SetChoke(choke bool) {
 	if choke != p.am_choking {
 		p.am_choking = choke
@@ -118,7 +194,7 @@ func (p *peerState) SetChoke(choke bool) {
 
 func (p *peerState) SetInterested(interested bool) {
 	if interested != p.am_interested {
-		// log.Println("SetInterested", interested, p.address)
+		p.log.Debug("Set interested", "interested", interested)
 		p.am_interested = interested
 		b := byte(3)
 		if interested {
@@ -128,19 +204,35 @@ func (p *peerState) SetInterested(interested bool) {
 	}
 }
 
+func (p *peerState) sendHave(piece int) {
+	haveMsg := make([]byte, 5)
+	haveMsg[0] = HAVE
+	uint32ToBytes(haveMsg[1:5], uint32(piece))
+	p.sendMessage(haveMsg)
+}
+
+// sendBitfield tells a new peer which pieces we have. It must be the first
+// message after the header.
+func (p *peerState) sendBitfield(pieces *Bitset) {
+	p.sendMessage(append([]byte{BITFIELD}, pieces.Bytes()...))
+}
+
 func (p *peerState) sendOneCharMessage(b byte) {
-	// log.Println("ocm", b, p.address)
+	p.log.Debug("Sending message", "type", b)
 	p.sendMessage([]byte{b})
 }
 
 func (p *peerState) sendMessage(b []byte) {
+	if p.closed {
+		return
+	}
 	p.writeChan <- b
 	p.lastWriteTime = time.Now()
 }
 
 func (p *peerState) keepAlive(now time.Time) {
 	if now.Sub(p.lastWriteTime) >= 2*time.Minute {
-		// log.Stderr("Sending keep alive", p)
+		p.log.Debug("Sending keep alive")
 		p.sendMessage([]byte{})
 	}
 }
@@ -178,38 +270,75 @@ func readNBOUint32(conn net.Conn) (n uint32, err error) {
 	return
 }
 
+// deliver hands a message to the session's main goroutine, unless the
+// session has stopped and done is closed.
+func deliver(msgChan chan peerMessage, done <-chan struct{}, m peerMessage) bool {
+	select {
+	case msgChan <- m:
+		return true
+	case <-done:
+		return false
+	}
+}
+
 // This func is designed to be run as a goroutine. It
 // listens for messages on a channel and sends them to a peer.
 
-func (p *peerState) peerWriter(errorChan chan peerMessage, header []byte) {
-	// log.Println("Writing header.")
+func (p *peerState) peerWriter(errorChan chan peerMessage, done <-chan struct{}, header []byte) {
+	var piece []byte // Piece data waiting for upload tokens
+	var ready <-chan time.Time
 	_, err := p.conn.Write(header)
 	if err != nil {
 		goto exit
 	}
-	// log.Println("Writing messages")
-	for msg := range p.writeChan2 {
-		// log.Println("Writing", len(msg), conn.RemoteAddr())
+	for {
+		pieces := p.pieceChan
+		if piece != nil {
+			pieces = nil
+		}
+		var msg []byte
+		var ok bool
+		// Protocol messages go first, even while piece data waits for tokens.
+		select {
+		case msg, ok = <-p.writeChan2:
+		default:
+			select {
+			case msg, ok = <-p.writeChan2:
+			case msg, ok = <-pieces:
+				if ok {
+					if d := reserveTokens(len(msg), p.uploadLimits); d > 0 {
+						piece, ready = msg, time.After(d)
+						continue
+					}
+				}
+			case <-ready:
+				msg, ok = piece, true
+				piece, ready = nil, nil
+			case <-done:
+				goto exit
+			}
+		}
+		if !ok {
+			goto exit
+		}
 		err = writeNBOUint32(p.conn, uint32(len(msg)))
 		if err != nil {
 			goto exit
 		}
 		_, err = p.conn.Write(msg)
 		if err != nil {
-			// log.Println("Failed to write a message", p.address, len(msg), msg, err)
 			goto exit
 		}
 	}
 exit:
-	// log.Println("peerWriter exiting")
-	errorChan <- peerMessage{p, nil}
+	p.log.Debug("Writer exiting", "err", err)
+	deliver(errorChan, done, peerMessage{p, nil})
 }
 
 // This func is designed to be run as a goroutine. It
 // listens for messages from the peer and forwards them to a channel.
 
-func (p *peerState) peerReader(msgChan chan peerMessage) {
-	// log.Println("Reading header.")
+func (p *peerState) peerReader(msgChan chan peerMessage, done <-chan struct{}) {
 	var header [68]byte
 	_, err := p.conn.Read(header[0:1])
 	if err != nil {
@@ -230,8 +359,9 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 	if err != nil {
 		goto exit
 	}
-	msgChan <- peerMessage{p, header[20:]}
-	// log.Println("Reading messages")
+	if !deliver(msgChan, done, peerMessage{p, header[20:]}) {
+		return
+	}
 	for {
 		var n uint32
 		n, err = readNBOUint32(p.conn)
@@ -239,7 +369,7 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 			goto exit
 		}
 		if n > 130*1024 {
-			// log.Println("Message size too large: ", n)
+			p.log.Warn("Message too large", "size", n)
 			goto exit
 		}
 		buf := make([]byte, n)
@@ -247,10 +377,16 @@ func (p *peerState) peerReader(msgChan chan peerMessage) {
 		if err != nil {
 			goto exit
 		}
-		msgChan <- peerMessage{p, buf}
+		// Waiting before the next read lets TCP flow control slow the peer down.
+		if n > 0 && buf[0] == PIECE && !waitForTokens(int(n), p.downloadLimits, done) {
+			return
+		}
+		if !deliver(msgChan, done, peerMessage{p, buf}) {
+			return
+		}
 	}
 
 exit:
-	msgChan <- peerMessage{p, nil}
-	// log.Println("peerReader exiting")
+	p.log.Debug("Reader exiting", "err", err)
+	deliver(msgChan, done, peerMessage{p, nil})
 }
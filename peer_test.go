@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdatePipeline(t *testing.T) {
+	p := NewPeerState(nil)
+	p.updatePipeline(time.Second)
+	if p.maxRequests != MIN_OUR_REQUESTS {
+		t.Errorf("Idle peer should get %d requests, got %d", MIN_OUR_REQUESTS, p.maxRequests)
+	}
+
+	// 3 MiB/s with 100ms latency needs far more than two blocks in flight.
+	p.minLatency = 100 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		p.bytesReceived = 3 * 1024 * 1024
+		p.updatePipeline(time.Second)
+	}
+	if p.maxRequests < 100 || p.maxRequests > MAX_OUR_REQUESTS {
+		t.Errorf("Fast peer got %d requests", p.maxRequests)
+	}
+
+	p.reqq = 50
+	p.bytesReceived = 3 * 1024 * 1024
+	p.updatePipeline(time.Second)
+	if p.maxRequests != 50 {
+		t.Errorf("Wanted the peer's reqq of 50, got %d", p.maxRequests)
+	}
+}
+
+func TestBitfieldSentFirst(t *testing.T) {
+	ts := &TorrentSession{m: &MetaInfo{InfoHash: "01234567890123456789"},
+		si: &SessionInfo{PeerId: "-tt0123456789012345"}, totalPieces: 10, pieceSet: NewBitset(10),
+		goodPieces: 2, peers: make(map[string]*peerState), peerMessageChan: make(chan peerMessage, 2),
+		uploadLimit: newTokenBucket(0), downloadLimit: newTokenBucket(0)}
+	ts.ctx, ts.cancel = context.WithCancel(context.Background())
+	defer ts.cancel()
+	ts.pieceSet.Set(0)
+	ts.pieceSet.Set(9)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ts.AddPeer(c1)
+	defer ts.ClosePeer(ts.peers[c1.RemoteAddr().String()])
+
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	var header [68]byte
+	if _, err := io.ReadFull(c2, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	n, err := readNBOUint32(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, n)
+	if _, err = io.ReadFull(c2, msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{BITFIELD, 0x80, 0x40}; !bytes.Equal(msg, want) {
+		t.Errorf("First message %x, want %x", msg, want)
+	}
+}
+
+// A stopped session doesn't read peer messages any more. The peer's
+// goroutines must still exit once it is closed.
+func TestPeerGoroutinesExitAfterStop(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewPeerState(c1)
+	ctx, cancel := context.WithCancel(context.Background())
+	msgChan := make(chan peerMessage)
+	exited := make(chan bool)
+	go func() {
+		p.peerWriter(msgChan, ctx.Done(), nil)
+		exited <- true
+	}()
+	go func() {
+		p.peerReader(msgChan, ctx.Done())
+		exited <- true
+	}()
+	cancel()
+	p.Close()
+	p.Close()
+	p.sendMessage([]byte{CHOKE})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Peer goroutines still running")
+		}
+	}
+}
+
+// Protocol messages overtake piece data that waits for upload tokens, and
+// closing the peer stops the wait.
+func TestControlMessagesSkipRateLimit(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewPeerState(c1)
+	p.uploadLimits = []*tokenBucket{newTokenBucket(1000)}
+	msgChan := make(chan peerMessage, 1)
+	exited := make(chan bool)
+	go func() {
+		p.peerWriter(msgChan, nil, []byte{19})
+		exited <- true
+	}()
+	block := make([]byte, 1+STANDARD_BLOCK_LENGTH)
+	block[0] = PIECE
+	p.sendMessage(block)
+	p.sendMessage(block)
+	p.sendOneCharMessage(CHOKE)
+
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c2, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for pieces := 0; ; pieces++ {
+		n, err := readNBOUint32(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(c2, msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] == CHOKE {
+			break
+		}
+		if pieces > 0 {
+			t.Fatal("CHOKE waited behind rate limited piece data")
+		}
+	}
+	p.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writer still waiting for tokens after the peer closed")
+	}
+}
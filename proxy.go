@@ -1,21 +1,114 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"net"
 	"net/http"
-
-	"github.com/hailiang/gosocks"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func init() {
-	flag.StringVar(&proxyAddress, "proxyAddress", "", "Address of a SOCKS5 proxy to use.")
+	flag.StringVar(&proxyURL, "proxy", "", "URL of a proxy to use: socks5://[user:pass@]host:port, "+
+		"socks4a://[user@]host:port, http://[user:pass@]host:port or https://[user:pass@]host:port.")
+	flag.StringVar(&proxyAddress, "proxyAddress", "", "Address of a SOCKS5 proxy to use. Deprecated, use -proxy.")
+	flag.BoolVar(&proxyStrict, "proxyStrict", false, "Never send traffic around the proxy. Disables DHT and "+
+		"UPnP, and refuses UDP traffic the proxy can't carry.")
+	flag.BoolVar(&proxyBind, "proxyBind", false, "Accept incoming peer connections through SOCKS5 BIND requests.")
 }
 
+var proxyURL string
 var proxyAddress string
+var proxyStrict bool
+var proxyBind bool
+
+const proxyDialTimeout = 30 * time.Second
+
+// SOCKS servers usually listen on a new port for each BIND. We tell the
+// tracker about a new port at most this often.
+const proxyPortAnnounceInterval = 5 * time.Minute
+
+// The proxy parsed from the command line, nil if none. Set by initProxy.
+var proxy *proxyConfig
+
+type proxyConfig struct {
+	u        *url.URL
+	scheme   string
+	addr     string // host:port of the proxy itself
+	user     string
+	password string
+}
+
+// initProxy validates the proxy flags. Call once, after flag.Parse.
+func initProxy() (err error) {
+	s := proxyURL
+	if s == "" && proxyAddress != "" {
+		s = "socks5://" + proxyAddress
+	}
+	if s == "" {
+		if proxyStrict || proxyBind {
+			return errors.New("-proxyStrict and -proxyBind require -proxy.")
+		}
+		return
+	}
+	if proxy, err = parseProxyURL(s); err != nil {
+		return
+	}
+	if proxyBind && proxy.scheme != "socks5" {
+		return errors.New("-proxyBind needs a socks5 proxy.")
+	}
+	if proxyStrict {
+		if useDHT || useUPnP {
+			sessionLog.Info("Strict proxy mode: disabling DHT and UPnP")
+		}
+		useDHT = false
+		useUPnP = false
+	} else if useDHT {
+		dhtLog.Warn("DHT traffic does not go through the proxy")
+	}
+	return
+}
+
+func parseProxyURL(s string) (p *proxyConfig, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return
+	}
+	p = &proxyConfig{u: u, scheme: strings.ToLower(u.Scheme), addr: u.Host}
+	if u.User != nil {
+		p.user = u.User.Username()
+		p.password, _ = u.User.Password()
+	}
+	defaultPort := ""
+	switch p.scheme {
+	case "socks5", "socks5h", "socks4a":
+		p.scheme = strings.TrimSuffix(p.scheme, "h")
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	default:
+		return nil, errors.New("Unsupported proxy scheme " + u.Scheme)
+	}
+	if p.addr == "" {
+		return nil, errors.New("Missing proxy host in " + s)
+	}
+	if _, _, err2 := net.SplitHostPort(p.addr); err2 != nil {
+		p.addr = net.JoinHostPort(p.addr, defaultPort)
+	}
+	return
+}
 
 func useProxy() bool {
-	return len(proxyAddress) > 0
+	return proxy != nil
 }
 
 func proxyHttpGet(url string) (r *http.Response, e error) {
@@ -24,18 +117,230 @@ func proxyHttpGet(url string) (r *http.Response, e error) {
 
 func proxyNetDial(netType, addr string) (net.Conn, error) {
 	if useProxy() {
-		return socks.DialSocksProxy(socks.SOCKS5, proxyAddress)(netType, addr)
+		return proxy.dial(netType, addr)
 	}
 	return net.Dial(netType, addr)
 }
 
 func proxyHttpClient() (client *http.Client) {
 	if useProxy() {
-		dialSocksProxy := socks.DialSocksProxy(socks.SOCKS5, proxyAddress)
-		tr := &http.Transport{Dial: dialSocksProxy}
+		var tr *http.Transport
+		if proxy.scheme == "http" || proxy.scheme == "https" {
+			// net/http speaks to HTTP proxies itself, including CONNECT for
+			// https URLs and Proxy-Authorization from the URL's user info.
+			tr = &http.Transport{Proxy: http.ProxyURL(proxy.u)}
+		} else {
+			tr = &http.Transport{Dial: proxy.dial}
+		}
 		client = &http.Client{Transport: tr}
 	} else {
 		client = &http.Client{}
 	}
 	return
 }
+
+// proxyListenPacket returns a datagram socket for UDP tracker traffic. With a
+// SOCKS5 proxy the datagrams go through a UDP associate relay. Other proxies
+// can't carry UDP, so we either go direct or, in strict mode, refuse.
+func proxyListenPacket() (net.PacketConn, error) {
+	if useProxy() {
+		if proxy.scheme == "socks5" {
+			return proxy.udpAssociate()
+		}
+		if proxyStrict {
+			return nil, errors.New("The " + proxy.scheme + " proxy can't carry UDP traffic.")
+		}
+		sessionLog.Warn("UDP traffic is bypassing the proxy", "proxy", proxy.scheme)
+	}
+	return net.ListenPacket("udp", ":0")
+}
+
+func (p *proxyConfig) dialProxy() (conn net.Conn, err error) {
+	conn, err = net.DialTimeout("tcp", p.addr, proxyDialTimeout)
+	if err != nil {
+		return nil, errors.New("Could not reach proxy " + p.addr + ": " + err.Error())
+	}
+	if p.scheme == "https" {
+		host, _, _ := net.SplitHostPort(p.addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	return
+}
+
+func (p *proxyConfig) dial(netType, addr string) (conn net.Conn, err error) {
+	if netType != "tcp" && netType != "tcp4" && netType != "tcp6" {
+		return nil, errors.New("Proxy can't dial network " + netType)
+	}
+	if conn, err = p.dialProxy(); err != nil {
+		return
+	}
+	// Don't let a stalled proxy hang the handshake forever.
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	switch p.scheme {
+	case "socks5":
+		_, err = socks5Handshake(conn, socks5Connect, addr, p.user, p.password)
+	case "socks4a":
+		err = socks4aHandshake(conn, addr, p.user)
+	default:
+		conn, err = p.httpConnect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &proxiedConn{conn, proxyAddr(addr)}, nil
+}
+
+// bind asks the proxy to accept one incoming connection for us. The port the
+// proxy listens on is sent to portChan so it can be announced, then bind
+// waits for a peer to connect. Cancelling ctx gives up the bind.
+func (p *proxyConfig) bind(ctx context.Context, portChan chan int) (conn net.Conn, err error) {
+	if conn, err = p.dialProxy(); err != nil {
+		return
+	}
+	bindDone := make(chan bool)
+	defer close(bindDone)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-bindDone:
+		}
+	}(conn)
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	bound, err := socks5Handshake(conn, socks5Bind, "0.0.0.0:0", p.user, p.password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, portString, _ := net.SplitHostPort(bound)
+	port, _ := strconv.Atoi(portString)
+	select {
+	case portChan <- port:
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	peer, err := readSocks5Reply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &proxiedConn{conn, proxyAddr(peer)}, nil
+}
+
+// acceptThroughProxy feeds peers that connect through SOCKS5 BIND requests to
+// conChan. A bind only accepts a single connection and the proxy may listen
+// on a different port for the next one, so we keep issuing them until ctx
+// is done.
+func acceptThroughProxy(ctx context.Context, conChan chan net.Conn, portChan chan int) {
+	for {
+		conn, err := proxy.bind(ctx, portChan)
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			peerLog.Error("Proxy bind failed", "err", err)
+			select {
+			case <-time.After(30 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case conChan <- conn:
+		case <-ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func (p *proxyConfig) httpConnect(conn net.Conn, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if p.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	r, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return conn, err
+	}
+	if r.StatusCode != 200 {
+		return conn, errors.New("HTTP proxy refused CONNECT to " + addr + ": " + r.Status)
+	}
+	// The peer may start talking before we do, so keep whatever the reader
+	// has already buffered.
+	return &bufferedConn{conn, br}, nil
+}
+
+func (p *proxyConfig) udpAssociate() (pc net.PacketConn, err error) {
+	control, err := p.dialProxy()
+	if err != nil {
+		return
+	}
+	local, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		control.Close()
+		return
+	}
+	control.SetDeadline(time.Now().Add(proxyDialTimeout))
+	// We don't know our address as the proxy sees it, so tell it 0.0.0.0:0.
+	bound, err := socks5Handshake(control, socks5UDPAssociate, "0.0.0.0:0", p.user, p.password)
+	if err == nil {
+		control.SetDeadline(time.Time{})
+		var relay *net.UDPAddr
+		if relay, err = net.ResolveUDPAddr("udp", bound); err == nil {
+			if relay.IP.IsUnspecified() {
+				// Some servers expect us to reuse the proxy's own address.
+				relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+			}
+			return &socks5PacketConn{local, control, relay}, nil
+		}
+	}
+	local.Close()
+	control.Close()
+	return
+}
+
+// proxiedConn reports the address of the peer at the far end of the proxy
+// rather than the proxy's own address.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "tcp" }
+func (a proxyAddr) String() string  { return string(a) }
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rates are in KiB/s on the command line, bytes per second everywhere else.
+// A rate of 0 means unlimited.
+var maxUploadRate int
+var maxDownloadRate int
+var rateScheduleFlag string
+
+func init() {
+	flag.IntVar(&maxUploadRate, "maxUploadRate", 0, "Upload rate limit for all torrents in KiB/s. 0 means unlimited.")
+	flag.IntVar(&maxDownloadRate, "maxDownloadRate", 0, "Download rate limit for all torrents in KiB/s. 0 means unlimited.")
+	flag.StringVar(&rateScheduleFlag, "rateSchedule", "", "Time of day rate limits, as a comma separated list of "+
+		"start-end:up/down entries in local time and KiB/s, e.g. 09:00-18:00:50/200,18:00-23:00:0/500. "+
+		"Outside of these windows -maxUploadRate and -maxDownloadRate apply. Limits changed while running "+
+		"last until a window starts or ends.")
+}
+
+// Limits shared by every torrent session in this process.
+var globalUploadLimit = newTokenBucket(0)
+var globalDownloadLimit = newTokenBucket(0)
+
+// A tokenBucket meters bytes at a given rate. Callers take tokens whether or
+// not they are available and then wait off the debt, so a large block is
+// never starved by a stream of small ones.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	b := &tokenBucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate in bytes per second. Safe to call at any time.
+func (b *tokenBucket) SetRate(rate int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	b.rate = float64(rate)
+	b.tokens = b.burst()
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) Rate() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.rate)
+}
+
+func (b *tokenBucket) burst() float64 {
+	// One second worth of traffic, but always enough for a whole block.
+	if b.rate < STANDARD_BLOCK_LENGTH {
+		return STANDARD_BLOCK_LENGTH
+	}
+	return b.rate
+}
+
+// reserve takes n tokens and returns how long the caller has to wait before
+// using them.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if burst := b.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// reserveTokens takes n tokens from every bucket and returns how long to
+// wait before using them.
+func reserveTokens(n int, buckets []*tokenBucket) (wait time.Duration) {
+	now := time.Now()
+	for _, b := range buckets {
+		if d := b.reserve(n, now); d > wait {
+			wait = d
+		}
+	}
+	return
+}
+
+// waitForTokens blocks until every bucket allows n more bytes. Returns false
+// if done is closed first.
+func waitForTokens(n int, buckets []*tokenBucket, done <-chan struct{}) bool {
+	wait := reserveTokens(n, buckets)
+	if wait == 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// SetGlobalRateLimits changes the limits shared by all sessions, in bytes
+// per second.
+func SetGlobalRateLimits(up, down int) {
+	globalUploadLimit.SetRate(up)
+	globalDownloadLimit.SetRate(down)
+}
+
+type rateWindow struct {
+	start, end time.Duration // Since midnight. end < start wraps past midnight.
+	up, down   int           // Bytes per second.
+}
+
+type rateSchedule []rateWindow
+
+func parseRateSchedule(s string) (schedule rateSchedule, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// "09:00-18:00:50/200" splits into "09", "00-18", "00", "50/200".
+		parts := strings.SplitN(entry, ":", 4)
+		if len(parts) != 4 {
+			return nil, errors.New("Bad rate schedule entry " + entry)
+		}
+		middle := strings.SplitN(parts[1], "-", 2)
+		rates := strings.SplitN(parts[3], "/", 2)
+		if len(middle) != 2 || len(rates) != 2 {
+			return nil, errors.New("Bad rate schedule entry " + entry)
+		}
+		var w rateWindow
+		var e1, e2, e3, e4 error
+		w.start, e1 = parseTimeOfDay(parts[0] + ":" + middle[0])
+		w.end, e2 = parseTimeOfDay(middle[1] + ":" + parts[2])
+		w.up, e3 = strconv.Atoi(rates[0])
+		w.down, e4 = strconv.Atoi(rates[1])
+		if e1 != nil || e2 != nil || e3 != nil || e4 != nil || w.up < 0 || w.down < 0 {
+			return nil, errors.New("Bad rate schedule entry " + entry)
+		}
+		w.up *= 1024
+		w.down *= 1024
+		schedule = append(schedule, w)
+	}
+	return
+}
+
+func parseTimeOfDay(s string) (d time.Duration, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// limitsAt returns the limits of the first window containing now.
+func (s rateSchedule) limitsAt(now time.Time) (up, down int, ok bool) {
+	if i := s.windowAt(now); i >= 0 {
+		return s[i].up, s[i].down, true
+	}
+	return
+}
+
+// windowAt returns the index of the first window containing now, or -1.
+func (s rateSchedule) windowAt(now time.Time) int {
+	h, m, sec := now.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	for i, w := range s {
+		inside := tod >= w.start && tod < w.end
+		if w.end < w.start {
+			inside = tod >= w.start || tod < w.end
+		}
+		if inside {
+			return i
+		}
+	}
+	return -1
+}
+
+// initRateLimits applies the rate limit flags and starts the schedule, if
+// any. Call once, after flag.Parse.
+func initRateLimits() (err error) {
+	up, down := maxUploadRate*1024, maxDownloadRate*1024
+	SetGlobalRateLimits(up, down)
+	if rateScheduleFlag == "" {
+		return
+	}
+	schedule, err := parseRateSchedule(rateScheduleFlag)
+	if err != nil {
+		return
+	}
+	go runRateSchedule(newRateScheduler(schedule, up, down))
+	return
+}
+
+// A rateScheduler applies a rate schedule to the global limits. Limits set
+// while running, through the API or the TUI, are kept until the schedule
+// enters or leaves a window. Set outside every window, they also replace
+// the limits from the command line for the rest of the run.
+type rateScheduler struct {
+	schedule               rateSchedule
+	defaultUp, defaultDown int
+	window                 int // The window we are in, -1 for none
+	up, down               int // What we last set
+	started                bool
+}
+
+func newRateScheduler(schedule rateSchedule, defaultUp, defaultDown int) *rateScheduler {
+	return &rateScheduler{schedule: schedule, defaultUp: defaultUp, defaultDown: defaultDown}
+}
+
+func runRateSchedule(s *rateScheduler) {
+	for {
+		s.update(time.Now())
+		time.Sleep(time.Minute)
+	}
+}
+
+func (s *rateScheduler) update(now time.Time) {
+	up, down := globalUploadLimit.Rate(), globalDownloadLimit.Rate()
+	if s.started && s.window < 0 && (up != s.up || down != s.down) {
+		s.defaultUp, s.defaultDown = up, down
+	}
+	window := s.schedule.windowAt(now)
+	if s.started && window == s.window {
+		return
+	}
+	s.started = true
+	s.window = window
+	s.up, s.down = s.defaultUp, s.defaultDown
+	if window >= 0 {
+		s.up, s.down = s.schedule[window].up, s.schedule[window].down
+	}
+	if s.up != up || s.down != down {
+		sessionLog.Info("Rate schedule changed the limits, in KiB/s, 0 is unlimited", "upload", s.up/1024,
+			"download", s.down/1024)
+		SetGlobalRateLimits(s.up, s.down)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(32 * 1024)
+	now := b.last
+	// A new bucket holds one second worth of traffic.
+	for i := 0; i < 2; i++ {
+		if d := b.reserve(16*1024, now); d != 0 {
+			t.Errorf("Block %d should not wait, waited %v", i, d)
+		}
+	}
+	if d := b.reserve(16*1024, now); d != 500*time.Millisecond {
+		t.Errorf("Third block should wait 500ms, waited %v", d)
+	}
+	// The debt is paid off after half a second, then the bucket refills.
+	if d := b.reserve(32*1024, now.Add(1500*time.Millisecond)); d != 0 {
+		t.Errorf("Refilled bucket should not wait, waited %v", d)
+	}
+	b.SetRate(0)
+	if d := b.reserve(1<<30, time.Now()); d != 0 {
+		t.Errorf("Unlimited bucket should not wait, waited %v", d)
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	s, err := parseRateSchedule("09:00-18:00:50/200, 22:30-06:00:0/1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hour, minute int
+		up, down     int
+		ok           bool
+	}{
+		{8, 59, 0, 0, false},
+		{9, 0, 50 * 1024, 200 * 1024, true},
+		{17, 59, 50 * 1024, 200 * 1024, true},
+		{18, 0, 0, 0, false},
+		{23, 0, 0, 1000 * 1024, true},
+		{3, 0, 0, 1000 * 1024, true},
+	}
+	for _, test := range tests {
+		now := time.Date(2012, 1, 1, test.hour, test.minute, 0, 0, time.Local)
+		up, down, ok := s.limitsAt(now)
+		if up != test.up || down != test.down || ok != test.ok {
+			t.Errorf("At %02d:%02d got %v %v %v", test.hour, test.minute, up, down, ok)
+		}
+	}
+	for _, bad := range []string{"09:00-18:00", "9-18:50/50", "09:00-18:00:a/1", "25:00-26:00:1/1"} {
+		if _, err := parseRateSchedule(bad); err == nil {
+			t.Errorf("parseRateSchedule(%q) should have failed", bad)
+		}
+	}
+}
+
+// Limits set while running last until the schedule enters or leaves a
+// window.
+func TestRateSchedulerKeepsRuntimeLimits(t *testing.T) {
+	defer SetGlobalRateLimits(0, 0)
+	schedule, _ := parseRateSchedule("09:00-18:00:50/200")
+	s := newRateScheduler(schedule, 10, 20)
+	at := func(hour int) time.Time {
+		return time.Date(2012, 1, 1, hour, 0, 0, 0, time.Local)
+	}
+	check := func(when string, up, down int) {
+		if got, gotDown := globalUploadLimit.Rate(), globalDownloadLimit.Rate(); got != up || gotDown != down {
+			t.Errorf("%s: got %d/%d, wanted %d/%d", when, got, gotDown, up, down)
+		}
+	}
+	s.update(at(8))
+	check("Before the window", 10, 20)
+	// Set outside every window: the new defaults.
+	SetGlobalRateLimits(30, 40)
+	s.update(at(8))
+	check("After a runtime change", 30, 40)
+	s.update(at(9))
+	check("In the window", 50*1024, 200*1024)
+	SetGlobalRateLimits(1, 2)
+	s.update(at(10))
+	check("After a runtime change in the window", 1, 2)
+	s.update(at(18))
+	check("After the window", 30, 40)
+}
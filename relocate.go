@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var completedDir string
+
+func init() {
+	flag.StringVar(&completedDir, "completedDir", "", "Move finished downloads to this directory, and seed them "+
+		"from there. Files only show up here once they are complete.")
+}
+
+// A FileStore that can move its files while in use.
+type relocatableStore interface {
+	FileStore
+	Relocate(dir string) error
+}
+
+// RELOCATE_COPY_PASSES is how many times Relocate copies what was written
+// during the previous pass, while reads and writes carry on, before it
+// copies the rest holding them up.
+const RELOCATE_COPY_PASSES = 3
+
+// Relocate moves the torrent's file, or its directory for a multi-file
+// torrent, into dir and carries on using it there.
+func (f *fileStore) Relocate(dir string) error {
+	return f.relocate(dir, f.closeFiles, f.reopen)
+}
+
+// relocate does the move for Relocate. Reads and writes only wait while
+// closeFiles, a rename and reopen run. When the move is to another file
+// system the files are copied first, without holding them up, and only the
+// files written to meanwhile are copied again.
+func (f *fileStore) relocate(dir string, closeFiles func(), reopen func() error) (err error) {
+	f.moving.Lock()
+	defer f.moving.Unlock()
+	// Only relocate changes root, so we can read it without f.mu.
+	oldRoot := f.root
+	newRoot := path.Join(dir, path.Base(oldRoot))
+	if newRoot == oldRoot {
+		return
+	}
+	if _, err = os.Lstat(newRoot); err == nil {
+		return errors.New("Can't move " + oldRoot + ": " + newRoot + " already exists.")
+	}
+	if err = ensureDirectory(newRoot); err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	closeFiles()
+	if err = os.Rename(oldRoot, newRoot); err != nil {
+		// Usually because dir is on another file system.
+		err = reopen()
+		f.mu.Unlock()
+		if err != nil {
+			return
+		}
+		// The copy is made under a hidden name next to newRoot and only
+		// renamed once it is complete.
+		tmp := path.Join(path.Dir(newRoot), "."+path.Base(newRoot)+".moving")
+		os.RemoveAll(tmp)
+		if err = f.copyWhileWriting(oldRoot, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return
+		}
+		// copyWhileWriting returns holding f.mu.
+		closeFiles()
+		if err = os.Rename(tmp, newRoot); err != nil {
+			os.RemoveAll(tmp)
+			if err2 := reopen(); err2 != nil {
+				storageLog.Error("Could not reopen files after failed move", "err", err2)
+			}
+			f.mu.Unlock()
+			return
+		}
+		defer os.RemoveAll(oldRoot)
+	}
+	f.root = newRoot
+	for i, _ := range f.files {
+		if name := f.files[i].name; name != "" {
+			f.files[i].name = newRoot + name[len(oldRoot):]
+		}
+	}
+	if f.partsName != "" {
+		f.partsName = newRoot + f.partsName[len(oldRoot):]
+	}
+	err = reopen()
+	f.mu.Unlock()
+	return
+}
+
+// copyWhileWriting copies the tree at src to dst while reads and writes go
+// on, then copies again the files written to during the copy, until a pass
+// finds nothing new. It returns holding f.mu, with dst up to date, unless it
+// fails.
+func (f *fileStore) copyWhileWriting(src, dst string) (err error) {
+	written := f.writeCounts()
+	if err = copyTree(src, dst); err != nil {
+		return
+	}
+	for pass := 1; ; pass++ {
+		f.mu.Lock()
+		counts := f.writeCounts()
+		var names []string
+		for i, _ := range f.files {
+			if counts[i] == written[i] {
+				continue
+			}
+			if name := f.files[i].name; name != "" {
+				names = append(names, name)
+			} else {
+				names = append(names, f.partsName)
+			}
+		}
+		if len(names) == 0 {
+			return
+		}
+		if pass < RELOCATE_COPY_PASSES {
+			f.mu.Unlock()
+			if err = copyFiles(src, dst, names); err != nil {
+				return
+			}
+			written = counts
+			continue
+		}
+		// Writes keep coming. Hold them up for the last pass.
+		if err = copyFiles(src, dst, names); err != nil {
+			f.mu.Unlock()
+		}
+		return
+	}
+}
+
+// writeCounts returns how many writes each file has had.
+func (f *fileStore) writeCounts() (counts []int64) {
+	counts = make([]int64, len(f.files))
+	for i, _ := range f.files {
+		counts[i] = atomic.LoadInt64(&f.files[i].writes)
+	}
+	return
+}
+
+func (f *fileStore) reopen() (err error) {
+	if f.partsName != "" {
+		if f.parts, err = os.OpenFile(f.partsName, os.O_RDWR, 0600); err != nil {
+			return
+		}
+	}
+	for i, _ := range f.files {
+		fe := &f.files[i]
+		if fe.name == "" {
+			fe.parts = f.parts
+		} else if fe.fd, err = os.OpenFile(fe.name, os.O_RDWR, 0600); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// copyFiles copies the named files in the tree at src to the same places
+// in the tree at dst.
+func copyFiles(src, dst string, names []string) (err error) {
+	for _, name := range names {
+		var fi os.FileInfo
+		if fi, err = os.Stat(name); err != nil {
+			return
+		}
+		if err = copyFile(name, dst+name[len(src):], fi.Mode()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, name[len(src):])
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(name, target, fi.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return
+}
+
+// Relocate moves the session's files into dir while it keeps running.
+// Reads and writes only wait while the files are closed, renamed and opened
+// again. Safe to call from any goroutine, but it blocks for as long as the
+// move takes.
+func (t *TorrentSession) Relocate(dir string) (err error) {
+	store, ok := t.fileStore.(relocatableStore)
+	if !ok {
+		return errors.New("This storage backend can't be relocated.")
+	}
+	l := t.logger(storageLog).With("dir", dir)
+	l.Info("Moving files")
+	if err = store.Relocate(dir); err != nil {
+		l.Error("Could not move files", "err", err)
+		return
+	}
+	l.Info("Moved files")
+	return
+}
+
+// moveCompleted moves a finished download to -completedDir, in the
+// background.
+func (t *TorrentSession) moveCompleted() {
+	if completedDir == "" || t.movedToCompleted || t.ctx.Err() != nil || !t.filesComplete() {
+		return
+	}
+	t.movedToCompleted = true
+	go t.Relocate(completedDir)
+}
+
+// completedStoreDir returns where a torrent's files go if they have already
+// been moved to -completedDir, or dir if they haven't.
+func completedStoreDir(info *InfoDict, dir string) string {
+	if completedDir == "" {
+		return dir
+	}
+	candidate := path.Join(completedDir, path.Base(dir))
+	if len(info.Files) == 0 {
+		name, _ := torrentName(info)
+		if _, err := os.Stat(path.Join(completedDir, name)); err == nil {
+			return completedDir
+		}
+	} else if _, err := os.Stat(candidate); err == nil {
+		return candidate
+	}
+	return dir
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileStoreRelocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	incomplete, complete := path.Join(dir, "incomplete"), path.Join(dir, "complete")
+	fs, _, err := NewFileStore(&storageTestInfo, path.Join(incomplete, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	data := []byte("0123456789abcdefghijklmnopqrst")
+	if _, err = fs.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.(relocatableStore).Relocate(complete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(incomplete, "test")); !os.IsNotExist(err) {
+		t.Errorf("Old directory should be gone, stat says %v", err)
+	}
+	if _, err = os.Stat(path.Join(complete, "test", "dir", "b")); err != nil {
+		t.Errorf("Moved file is missing: %v", err)
+	}
+	got := make([]byte, len(data))
+	if _, err = fs.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Wanted %q after the move, got %q", data, got)
+	}
+	if _, err = fs.WriteAt([]byte("X"), 29); err != nil {
+		t.Errorf("Writing after the move failed: %v", err)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "src")
+	os.MkdirAll(path.Join(src, "sub"), 0755)
+	ioutil.WriteFile(path.Join(src, "sub", "f"), []byte("hello"), 0644)
+	// copyTree is what Relocate falls back to across file systems.
+	dst := path.Join(dir, "dst")
+	if err = copyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(dst, "sub", "f")); err != nil || string(b) != "hello" {
+		t.Errorf("Copy has %q, %v", b, err)
+	}
+	fs, _, err := NewFileStore(&storageTestInfo, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	os.MkdirAll(path.Join(dir, "other", "src"), 0755)
+	if err = fs.(relocatableStore).Relocate(path.Join(dir, "other")); err == nil {
+		t.Errorf("Moving over an existing directory should fail")
+	}
+}
+
+// Writes carry on during the copy, and still end up in it.
+func TestCopyWhileWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relocate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "test")
+	store, _, err := NewFileStore(&storageTestInfo, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fs := store.(*fileStore)
+	stop := make(chan bool)
+	writing := make(chan bool)
+	go func() {
+		defer close(writing)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Blocks while copyWhileWriting holds the lock at the end.
+			fs.WriteAt([]byte{byte(i)}, int64(i%30))
+		}
+	}()
+	dst := path.Join(dir, "copy")
+	if err = fs.copyWhileWriting(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 30)
+	fs.readAt(want, 0)
+	fs.mu.Unlock()
+	close(stop)
+	<-writing
+	copied, _, err := NewFileStore(&storageTestInfo, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	got := make([]byte, 30)
+	copied.ReadAt(got, 0)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Copy has %v, wanted %v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+// Resume data lets a session skip hashing everything when it starts. It
+// holds the pieces we had when the session stopped, and the size and
+// modification time of every file then. If any file has changed since, the
+// pieces are checked as usual.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	bencode "code.google.com/p/bencode-go"
+)
+
+type fileStamp struct {
+	Length int64 "length"
+	Mtime  int64 "mtime"
+}
+
+type resumeData struct {
+	InfoHash string      "info_hash"
+	Bitfield string      "bitfield"
+	Files    []fileStamp "files"
+}
+
+// A FileStore that can tell whether its files changed.
+type stampedStore interface {
+	fileStamps() ([]fileStamp, error)
+}
+
+func resumePath(m *MetaInfo) string {
+	return path.Join(fileDir, fmt.Sprintf(".%x.resume", m.InfoHash))
+}
+
+func (f *fileStore) fileStamps() (stamps []fileStamp, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i, _ := range f.files {
+		fe := &f.files[i]
+		fd := fe.fd
+		if fe.parts != nil {
+			fd = fe.parts
+		}
+		if fd == nil {
+			stamps = append(stamps, fileStamp{})
+			continue
+		}
+		var fi os.FileInfo
+		if fi, err = fd.Stat(); err != nil {
+			return
+		}
+		stamps = append(stamps, fileStamp{fi.Size(), fi.ModTime().UnixNano()})
+	}
+	return
+}
+
+// writeResume saves the pieces we have, for the next session. Stores that
+// can't tell whether their data changed get no resume data.
+func (t *TorrentSession) writeResume() (err error) {
+	if _, ok := t.fileStore.(stampedStore); !ok {
+		return
+	}
+	return writeResumeData(t.m, t.fileStore, t.pieceSet)
+}
+
+// writeResumeData saves pieces as what fs holds now, with the stamps of its
+// files.
+func writeResumeData(m *MetaInfo, fs FileStore, pieces *Bitset) (err error) {
+	s, ok := fs.(stampedStore)
+	if !ok {
+		return errors.New("The storage backend can't keep resume data.")
+	}
+	stamps, err := s.fileStamps()
+	if err != nil {
+		return
+	}
+	var b bytes.Buffer
+	err = bencode.Marshal(&b, resumeData{m.InfoHash, string(pieces.Bytes()), stamps})
+	if err != nil {
+		return
+	}
+	name := resumePath(m)
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, name)
+}
+
+// readResume returns the pieces we had when the last session stopped, or
+// nil if there is no resume data or the files changed since.
+func readResume(m *MetaInfo, fs FileStore, totalSize int64) (pieces *Bitset) {
+	s, ok := fs.(stampedStore)
+	if !ok {
+		return
+	}
+	data, err := ioutil.ReadFile(resumePath(m))
+	if err != nil {
+		return
+	}
+	var r resumeData
+	if err = bencode.Unmarshal(bytes.NewReader(data), &r); err != nil || r.InfoHash != m.InfoHash {
+		return
+	}
+	stamps, err := s.fileStamps()
+	if err != nil || !sameStamps(stamps, r.Files) {
+		return
+	}
+	numPieces := int((totalSize + m.Info.PieceLength - 1) / m.Info.PieceLength)
+	return NewBitsetFromBytes(numPieces, []byte(r.Bitfield))
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
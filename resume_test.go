@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _, err := NewFileStoreWithOptions(&storageTestInfo, dir, FileStoreOptions{Allocation: ALLOCATE_SPARSE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	s := fs.(stampedStore)
+	before, err := s.fileStamps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 3 || before[2].Length != 20 {
+		t.Fatalf("Got stamps %v", before)
+	}
+	again, _ := s.fileStamps()
+	if !sameStamps(before, again) {
+		t.Errorf("Stamps changed without a write: %v, %v", before, again)
+	}
+	// Make sure the modification time moves on, even on coarse clocks.
+	time.Sleep(10 * time.Millisecond)
+	if _, err = fs.WriteAt([]byte("x"), 12); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(dir+"/dir/b", time.Now(), time.Now().Add(time.Second))
+	after, _ := s.fileStamps()
+	if sameStamps(before, after) {
+		t.Errorf("Stamps didn't change after a write")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+// Torrent files come from strangers. Their names and paths must not be able
+// to point anywhere outside the directory we put the torrent in.
+
+import (
+	"errors"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	MAX_NAME_LENGTH = 255  // Bytes in one path element
+	MAX_PATH_LENGTH = 4096 // Bytes in a whole path
+)
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// torrentName returns the name of a torrent's file, or of the directory that
+// holds its files, preferring the name.utf-8 key.
+func torrentName(info *InfoDict) (name string, err error) {
+	name = info.Name
+	if info.NameUtf8 != "" {
+		name = info.NameUtf8
+	}
+	if name, err = cleanPathElement(name, runtime.GOOS == "windows"); err != nil {
+		err = errors.New("Bad torrent name: " + err.Error())
+	}
+	return
+}
+
+// torrentFilePaths returns the path of each file in torrentFiles order,
+// relative to the directory the torrent is stored in.
+func torrentFilePaths(info *InfoDict) (paths []string, err error) {
+	if len(info.Files) == 0 {
+		var name string
+		if name, err = torrentName(info); err != nil {
+			return
+		}
+		return []string{name}, nil
+	}
+	windows := runtime.GOOS == "windows"
+	paths = make([]string, len(info.Files))
+	for i, f := range info.Files {
+		elems := f.Path
+		if len(f.PathUtf8) != 0 {
+			elems = f.PathUtf8
+		}
+		if len(elems) == 0 {
+			return nil, errors.New("File " + strconv.Itoa(i) + " has an empty path.")
+		}
+		clean := make([]string, len(elems))
+		for j, e := range elems {
+			if clean[j], err = cleanPathElement(e, windows); err != nil {
+				return nil, errors.New("Bad path for file " + strconv.Itoa(i) + ": " + err.Error())
+			}
+		}
+		paths[i] = path.Join(clean...)
+		if len(paths[i]) > MAX_PATH_LENGTH {
+			return nil, errors.New("Path for file " + strconv.Itoa(i) + " is too long.")
+		}
+	}
+	return
+}
+
+// cleanPathElement checks one element of a path. Anything that could climb
+// out of the torrent's directory is an error. Names Windows can't store are
+// changed instead, when windows is set.
+func cleanPathElement(e string, windows bool) (string, error) {
+	switch {
+	case e == "":
+		return "", errors.New("empty file name")
+	case e == "." || e == "..":
+		return "", errors.New("file name " + e + " is not allowed")
+	case strings.IndexByte(e, 0) >= 0:
+		return "", errors.New("file name contains a NUL byte")
+	case strings.ContainsAny(e, "/\\"):
+		return "", errors.New("file name " + strconv.Quote(e) + " contains a path separator")
+	case len(e) > MAX_NAME_LENGTH:
+		return "", errors.New("file name " + strconv.Quote(e[:32]) + "... is too long")
+	}
+	if !windows {
+		return e, nil
+	}
+	// Drive letters, streams and wildcards all need one of these.
+	e = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune("<>:\"|?*", r) {
+			return '_'
+		}
+		return r
+	}, e)
+	// Windows drops trailing dots and spaces, so "..." would become "".
+	if trimmed := strings.TrimRight(e, ". "); trimmed != e {
+		e = trimmed + "_"
+	}
+	base := e
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReservedNames[strings.ToUpper(base)] {
+		e = "_" + e
+	}
+	return e, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanPathElement(t *testing.T) {
+	tests := []struct {
+		in      string
+		windows bool
+		out     string
+		ok      bool
+	}{
+		{"file.txt", false, "file.txt", true},
+		{"file.txt", true, "file.txt", true},
+		{"", false, "", false},
+		{".", false, "", false},
+		{"..", true, "", false},
+		{"a/b", false, "", false},
+		{"a\\b", false, "", false},
+		{"a\x00b", false, "", false},
+		{strings.Repeat("x", 256), false, "", false},
+		{"a:b?", false, "a:b?", true},
+		{"a:b?", true, "a_b_", true},
+		{"name. ", true, "name_", true},
+		{"...", true, "_", true},
+		{"con", true, "_con", true},
+		{"Lpt1.txt", true, "_Lpt1.txt", true},
+		{"console", true, "console", true},
+	}
+	for _, test := range tests {
+		out, err := cleanPathElement(test.in, test.windows)
+		if (err == nil) != test.ok {
+			t.Errorf("cleanPathElement(%q, %v) error %v, wanted ok %v", test.in, test.windows, err, test.ok)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("cleanPathElement(%q, %v) = %q, wanted %q", test.in, test.windows, out, test.out)
+		}
+	}
+}
+
+func TestTorrentFilePaths(t *testing.T) {
+	info := &InfoDict{Name: "dir", Files: []FileDict{
+		{Length: 1, Path: []string{"a", "b"}},
+		{Length: 1, Path: []string{"bad"}, PathUtf8: []string{"good"}},
+	}}
+	paths, err := torrentFilePaths(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "a/b" || paths[1] != "good" {
+		t.Errorf("Got paths %v", paths)
+	}
+	info.Files[0].Path = []string{"..", "etc", "passwd"}
+	if _, err = torrentFilePaths(info); err == nil {
+		t.Errorf("Path with .. was accepted")
+	}
+	info.Files[0].Path = nil
+	if _, err = torrentFilePaths(info); err == nil {
+		t.Errorf("Empty path was accepted")
+	}
+}
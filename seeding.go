@@ -0,0 +1,192 @@
+package main
+
+// Seeding goals. Once a download is complete we seed until the share ratio,
+// the seeding time or the time since anyone last downloaded from us reaches
+// its limit, and then stop or pause the session.
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var seedRatio float64
+var seedTime time.Duration
+var seedIdleTime time.Duration
+var seedGoalAction string
+var seedOnly bool
+var exitOnComplete bool
+
+func init() {
+	flag.Float64Var(&seedRatio, "seedRatio", 0, "Stop seeding once we have uploaded this many times what we "+
+		"downloaded. 0 means no limit.")
+	flag.DurationVar(&seedTime, "seedTime", 0, "Stop seeding after this long, e.g. 12h. 0 means no limit.")
+	flag.DurationVar(&seedIdleTime, "seedIdleTime", 0, "Stop seeding once nobody has downloaded from us for "+
+		"this long. 0 means no limit.")
+	flag.StringVar(&seedGoalAction, "seedGoalAction", "stop", "What to do when a seeding goal is reached: stop "+
+		"(the session ends) or pause (drop all peers, but keep the session).")
+	flag.BoolVar(&seedOnly, "seedOnly", false, "Only seed the pieces we already have. Don't download anything.")
+	flag.BoolVar(&exitOnComplete, "exitOnComplete", false, "Stop as soon as the download is complete, without "+
+		"seeding.")
+}
+
+// SeedingGoals say when a session is done seeding. Zero values mean no limit.
+type SeedingGoals struct {
+	Ratio    float64
+	Time     time.Duration // Since the download completed
+	IdleTime time.Duration // Since we last uploaded
+	Pause    bool          // Pause the session instead of stopping it
+}
+
+// initSeeding checks the seeding flags before any session starts.
+func initSeeding() error {
+	if seedGoalAction != "stop" && seedGoalAction != "pause" {
+		return errors.New("Unknown -seedGoalAction " + seedGoalAction + ".")
+	}
+	return nil
+}
+
+// defaultSeedingGoals returns the goals given on the command line.
+func defaultSeedingGoals() (goals SeedingGoals) {
+	goals = SeedingGoals{Ratio: seedRatio, Time: seedTime, IdleTime: seedIdleTime,
+		Pause: seedGoalAction == "pause"}
+	if exitOnComplete {
+		goals.Time = 0
+		goals.Ratio = 0
+		goals.IdleTime = 0
+		goals.Pause = false
+	}
+	return
+}
+
+type seedingState struct {
+	mu           sync.Mutex
+	goals        SeedingGoals
+	seedingSince time.Time // Zero until the download is complete
+	lastUpload   time.Time
+	paused       bool
+	complete     bool // We have all we want, and only seed
+}
+
+// SetSeedingGoals replaces this session's seeding goals. Safe to call from
+// any goroutine.
+func (t *TorrentSession) SetSeedingGoals(goals SeedingGoals) {
+	t.seeding.mu.Lock()
+	t.seeding.goals = goals
+	t.seeding.mu.Unlock()
+}
+
+func (t *TorrentSession) SeedingGoals() SeedingGoals {
+	t.seeding.mu.Lock()
+	defer t.seeding.mu.Unlock()
+	return t.seeding.goals
+}
+
+// shareRatio is uploaded over downloaded. If we had the whole torrent from
+// the start it is over the size of the torrent instead.
+func (t *TorrentSession) shareRatio() float64 {
+	base := t.si.Downloaded
+	if base == 0 {
+		base = t.totalSize
+	}
+	if base == 0 {
+		return 0
+	}
+	return float64(t.si.Uploaded) / float64(base)
+}
+
+// seedingGoalReached returns why we are done seeding, or "" if we aren't.
+func (t *TorrentSession) seedingGoalReached(now time.Time) string {
+	if t.seeding.seedingSince.IsZero() {
+		return ""
+	}
+	if exitOnComplete {
+		if t.filesComplete() {
+			return "the download is complete"
+		}
+		return ""
+	}
+	goals := t.SeedingGoals()
+	if goals.Ratio > 0 && t.shareRatio() >= goals.Ratio {
+		return "share ratio " + strconv.FormatFloat(t.shareRatio(), 'f', 2, 64) + " reached"
+	}
+	if goals.Time > 0 && now.Sub(t.seeding.seedingSince) >= goals.Time {
+		return "seeded for " + goals.Time.String()
+	}
+	idleSince := t.seeding.lastUpload
+	if idleSince.Before(t.seeding.seedingSince) {
+		idleSince = t.seeding.seedingSince
+	}
+	if goals.IdleTime > 0 && now.Sub(idleSince) >= goals.IdleTime {
+		return "nobody downloaded from us for " + goals.IdleTime.String()
+	}
+	return ""
+}
+
+// checkSeedingGoals stops or pauses the session once it is done seeding.
+func (t *TorrentSession) checkSeedingGoals(now time.Time) {
+	if t.seeding.seedingSince.IsZero() && t.downloadComplete() {
+		t.seeding.seedingSince = now
+	}
+	if t.seeding.paused {
+		return
+	}
+	reason := t.seedingGoalReached(now)
+	if reason == "" {
+		return
+	}
+	if t.SeedingGoals().Pause && !exitOnComplete {
+		t.logger(sessionLog).Info("Pausing", "reason", reason)
+		t.pause()
+	} else {
+		t.logger(sessionLog).Info("Stopping", "reason", reason)
+		t.Stop()
+	}
+}
+
+// pause drops all peers and leaves the swarm, but keeps the session.
+func (t *TorrentSession) pause() {
+	t.seeding.paused = true
+	for _, p := range t.peers {
+		t.ClosePeer(p)
+	}
+	if !trackerLessMode {
+		t.announceStopped()
+	}
+}
+
+// isSeed is whether a peer has the whole torrent.
+func (t *TorrentSession) isSeed(p *peerState) bool {
+	return p.have != nil && p.have.FindNextClear(0) < 0
+}
+
+// enterSeedingMode is called once the download is complete. We don't need
+// anything from anyone any more, and other seeds don't need anything from
+// us, so their connections are better used by leechers.
+func (t *TorrentSession) enterSeedingMode() {
+	if t.seeding.complete {
+		return
+	}
+	t.logger(sessionLog).Info("Download complete. Seeding.")
+	t.seeding.complete = true
+	if t.seeding.seedingSince.IsZero() {
+		t.seeding.seedingSince = time.Now()
+	}
+	for _, p := range t.peers {
+		p.SetInterested(false)
+		if t.isSeed(p) {
+			t.ClosePeer(p)
+		}
+	}
+}
+
+// seedOnlyPieces is the wanted set for -seedOnly: just what we have.
+func seedOnlyPieces(have *Bitset) (wanted *Bitset) {
+	wanted = NewBitset(have.n)
+	for i := have.FindNextSet(0); i >= 0; i = have.FindNextSet(i + 1) {
+		wanted.Set(i)
+	}
+	return
+}
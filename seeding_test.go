@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSeedingGoalReached(t *testing.T) {
+	start := time.Now()
+	ts := &TorrentSession{si: &SessionInfo{}, totalSize: 1000}
+	ts.SetSeedingGoals(SeedingGoals{Ratio: 2, Time: time.Hour, IdleTime: 10 * time.Minute})
+	if r := ts.seedingGoalReached(start); r != "" {
+		t.Errorf("Goal reached before the download completed: %s", r)
+	}
+	ts.seeding.seedingSince = start
+	ts.seeding.lastUpload = start
+	ts.si.Downloaded = 1000
+	ts.si.Uploaded = 1500
+	if r := ts.seedingGoalReached(start.Add(time.Minute)); r != "" {
+		t.Errorf("Goal reached too early: %s", r)
+	}
+	if r := ts.seedingGoalReached(start.Add(11 * time.Minute)); r == "" {
+		t.Errorf("Idle time not noticed")
+	}
+	ts.seeding.lastUpload = start.Add(59 * time.Minute)
+	if r := ts.seedingGoalReached(start.Add(time.Hour)); r == "" {
+		t.Errorf("Seeding time not noticed")
+	}
+	ts.si.Uploaded = 2000
+	if r := ts.seedingGoalReached(start.Add(time.Minute)); r == "" {
+		t.Errorf("Ratio not noticed")
+	}
+	// Seeding what we had from the start counts against the torrent size.
+	ts.si.Downloaded = 0
+	ts.si.Uploaded = 1999
+	if ratio := ts.shareRatio(); ratio > 2 || ratio < 1.99 {
+		t.Errorf("Share ratio %v, wanted 1.999", ratio)
+	}
+}
+
+func TestSeedOnlyPieces(t *testing.T) {
+	have := NewBitset(10)
+	have.Set(3)
+	have.Set(9)
+	wanted := seedOnlyPieces(have)
+	for i := 0; i < 10; i++ {
+		if wanted.IsSet(i) != have.IsSet(i) {
+			t.Errorf("Piece %d: wanted %v, have %v", i, wanted.IsSet(i), have.IsSet(i))
+		}
+	}
+}
+
+func TestSeedOnlyIsNotComplete(t *testing.T) {
+	defer func(s, e bool, d string) { seedOnly, exitOnComplete, completedDir = s, e, d }(seedOnly, exitOnComplete, completedDir)
+	seedOnly, exitOnComplete, completedDir = true, true, t.TempDir()
+	ts := &TorrentSession{m: &MetaInfo{Info: InfoDict{PieceLength: 10, Length: 40}},
+		si: &SessionInfo{}, ctx: context.Background(), totalPieces: 4, goodPieces: 2}
+	ts.pieceSet = NewBitset(4)
+	ts.pieceSet.Set(0)
+	ts.pieceSet.Set(2)
+	ts.wantedPieces = seedOnlyPieces(ts.pieceSet)
+	if !ts.downloadComplete() {
+		t.Errorf("Seed-only session wants more pieces")
+	}
+	if ts.filesComplete() {
+		t.Errorf("Seed-only session with half the pieces counted as complete")
+	}
+	ts.moveCompleted()
+	if ts.movedToCompleted {
+		t.Errorf("Partial torrent moved to -completedDir")
+	}
+	ts.enterSeedingMode()
+	if r := ts.seedingGoalReached(time.Now()); r != "" {
+		t.Errorf("Partial seed-only session stopped: %s", r)
+	}
+	ts.pieceSet.Set(1)
+	ts.pieceSet.Set(3)
+	ts.goodPieces = 4
+	if r := ts.seedingGoalReached(time.Now()); r == "" {
+		t.Errorf("Complete seed-only session kept going with -exitOnComplete")
+	}
+}
+
+func TestEnterSeedingMode(t *testing.T) {
+	ts := &TorrentSession{peers: make(map[string]*peerState), si: &SessionInfo{}}
+	for _, address := range []string{"seed:1", "leech:1"} {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		p := NewPeerState(c1)
+		p.address = address
+		p.am_interested = true
+		p.have = NewBitset(4)
+		ts.peers[address] = p
+		globalPeers++
+	}
+	for i := 0; i < 4; i++ {
+		ts.peers["seed:1"].have.Set(i)
+	}
+	ts.peers["leech:1"].have.Set(0)
+	leech := ts.peers["leech:1"]
+	ts.enterSeedingMode()
+	if _, ok := ts.peers["seed:1"]; ok {
+		t.Errorf("Still connected to a seed")
+	}
+	if _, ok := ts.peers["leech:1"]; !ok || leech.am_interested {
+		t.Errorf("Leecher should stay connected, without our interest")
+	}
+	if !ts.seeding.complete || ts.seeding.seedingSince.IsZero() {
+		t.Errorf("Session is not seeding")
+	}
+	ts.ClosePeer(leech)
+}
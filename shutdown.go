@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Shutting down may take at most this long, even if the tracker or the disk
+// doesn't answer.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Stop makes DoTorrent shut the session down and return. Safe to call from
+// any goroutine.
+func (t *TorrentSession) Stop() {
+	t.cancel()
+}
+
+// shutdown tells the tracker we are leaving, closes the peers, writes out
+// what is still in the cache, and closes the store. It runs on the main
+// goroutine once Stop is called.
+func (t *TorrentSession) shutdown() (err error) {
+	t.logger(sessionLog).Info("Stopping")
+	deadline, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	var announced chan bool
+	if !trackerLessMode && !t.seeding.paused {
+		announced = t.announceStopped()
+	}
+	for _, p := range t.peers {
+		t.ClosePeer(p)
+	}
+
+	// Let the disk writer finish what it has queued.
+	close(t.diskWrites)
+	flushed := false
+	for !flushed && err == nil {
+		select {
+		case w, ok := <-t.diskWritesDone:
+			if ok {
+				t.diskWriteDone(w)
+			} else {
+				flushed = true
+			}
+		case <-deadline.Done():
+			err = errors.New("Timed out writing to disk.")
+			close(t.diskWritesGone)
+		}
+	}
+	close(t.diskReads)
+	if flushed {
+		if err = t.writeResume(); err != nil {
+			t.logger(storageLog).Error("Could not write resume data", "err", err)
+		}
+	} else {
+		// What is on disk doesn't match what we know, so the pieces will
+		// be checked next time.
+		t.logger(storageLog).Error("Not writing resume data", "err", err)
+	}
+	// A write that is stuck holds the store's lock, and Close waits for it.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- t.fileStore.Close()
+	}()
+	select {
+	case err2 := <-closed:
+		if err2 != nil {
+			t.logger(storageLog).Error("Could not close files", "err", err2)
+		}
+	case <-deadline.Done():
+		t.logger(storageLog).Warn("Not waiting any longer for the files to close")
+	}
+
+	if t.nat != nil {
+		if err2 := t.nat.DeletePortMapping("TCP", t.listenPort); err2 != nil {
+			upnpLog.Warn("Unable to delete port mapping", "port", t.listenPort, "err", err2)
+		}
+	}
+	if announced != nil {
+		select {
+		case <-announced:
+		case <-deadline.Done():
+			t.logger(trackerLog).Warn("Tracker did not answer the stopped announce in time")
+		}
+	}
+	t.logger(sessionLog).Info("Stopped")
+	return
+}
+
+// announceStopped sends the stopped event to the tracker. The channel
+// receives once the tracker has answered.
+func (t *TorrentSession) announceStopped() (done chan bool) {
+	u, err := t.announceURL("stopped")
+	if err != nil {
+		t.logger(trackerLog).Error("Invalid announce URL", "url", t.m.Announce, "err", err)
+		return nil
+	}
+	done = make(chan bool, 1)
+	go func() {
+		if _, err := getTrackerInfo(u); err != nil {
+			t.logger(trackerLog).Error("Could not send stopped announce", "err", err)
+		}
+		done <- true
+	}()
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// stuckStore blocks writes until unblock is closed, and counts them.
+type stuckStore struct {
+	FileStore
+	unblock chan bool
+	writes  int
+}
+
+func (s *stuckStore) WriteAt(p []byte, off int64) (int, error) {
+	s.writes++
+	<-s.unblock
+	return len(p), nil
+}
+
+// Once shutdown stops waiting, the disk writer drops what is left and exits.
+func TestDiskWriterGivesUp(t *testing.T) {
+	store := &stuckStore{unblock: make(chan bool)}
+	ts := &TorrentSession{fileStore: store}
+	ts.startDiskWriter()
+	ts.diskWrites <- &diskWrite{data: []byte{1}}
+	ts.diskWrites <- &diskWrite{data: []byte{2}}
+	close(ts.diskWrites)
+	close(ts.diskWritesGone)
+	close(store.unblock)
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case _, ok := <-ts.diskWritesDone:
+			done = !ok
+		case <-timeout:
+			t.Fatal("Disk writer did not exit")
+		}
+	}
+	if store.writes > 1 {
+		t.Errorf("Disk writer went on writing, %d writes", store.writes)
+	}
+}
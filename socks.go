@@ -0,0 +1,278 @@
+package main
+
+// Just enough SOCKS to tunnel peer, tracker and UDP traffic through a proxy.
+// References:
+// - http://www.ietf.org/rfc/rfc1928.txt (SOCKS5)
+// - http://www.ietf.org/rfc/rfc1929.txt (SOCKS5 username/password)
+// - http://www.openssh.com/txt/socks4a.protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthNoAccept = 0xff
+
+	socks5Connect      = 1
+	socks5Bind         = 2
+	socks5UDPAssociate = 3
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5Handshake negotiates authentication and issues cmd for addr on an
+// already established connection to the proxy. It returns the address the
+// proxy reports in its reply: the relay address for a UDP associate and the
+// listening address for a bind.
+func socks5Handshake(conn net.Conn, cmd byte, addr, user, password string) (bound string, err error) {
+	method := byte(socks5AuthNone)
+	if user != "" {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return
+	}
+	if reply[0] != socks5Version {
+		err = errors.New("Unexpected SOCKS version " + strconv.Itoa(int(reply[0])))
+		return
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err = socks5Authenticate(conn, user, password); err != nil {
+			return
+		}
+	case socks5AuthNoAccept:
+		err = errors.New("SOCKS proxy did not accept our authentication method.")
+		return
+	default:
+		err = errors.New("SOCKS proxy chose unsupported authentication method " + strconv.Itoa(int(reply[1])))
+		return
+	}
+	req := []byte{socks5Version, cmd, 0}
+	if req, err = appendSocks5Addr(req, addr); err != nil {
+		return
+	}
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	return readSocks5Reply(conn)
+}
+
+func socks5Authenticate(conn net.Conn, user, password string) (err error) {
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("SOCKS user name or password too long.")
+	}
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	var reply [2]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return
+	}
+	if reply[1] != 0 {
+		err = errors.New("SOCKS proxy rejected user name or password.")
+	}
+	return
+}
+
+// readSocks5Reply reads a reply to a SOCKS5 request. A bind gets two of
+// these: one when the proxy starts listening, one when a peer connects.
+func readSocks5Reply(conn net.Conn) (bound string, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		err = errors.New("Unexpected SOCKS version " + strconv.Itoa(int(header[0])))
+		return
+	}
+	if code := int(header[1]); code != 0 {
+		reason := "unknown error " + strconv.Itoa(code)
+		if code < len(socks5Errors) {
+			reason = socks5Errors[code]
+		}
+		err = errors.New("SOCKS proxy: " + reason)
+		return
+	}
+	return readSocks5Addr(conn, header[3])
+}
+
+func appendSocks5Addr(b []byte, addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("Bad port in address " + addr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AddrIPv6)
+			b = append(b, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("Host name too long: " + host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+func readSocks5Addr(r io.Reader, addrType byte) (addr string, err error) {
+	var host string
+	switch addrType {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err = io.ReadFull(r, n[:]); err != nil {
+			return
+		}
+		name := make([]byte, n[0])
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		err = errors.New("Unknown SOCKS address type " + strconv.Itoa(int(addrType)))
+		return
+	}
+	var port [2]byte
+	if _, err = io.ReadFull(r, port[:]); err != nil {
+		return
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return
+}
+
+// socks4aHandshake asks a SOCKS4a proxy to connect to addr. Host names are
+// resolved by the proxy.
+func socks4aHandshake(conn net.Conn, addr, user string) (err error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return errors.New("Bad port in address " + addr)
+	}
+	req := []byte{4, 1, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		req = append(req, ip...)
+	} else {
+		// 0.0.0.x tells the proxy a host name follows the user id.
+		req = append(req, 0, 0, 0, 1)
+	}
+	req = append(req, user...)
+	req = append(req, 0)
+	if ip == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	var reply [8]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		return
+	}
+	if reply[1] != 0x5a {
+		err = errors.New("SOCKS4 proxy refused connection, code " + strconv.Itoa(int(reply[1])))
+	}
+	return
+}
+
+// socks5PacketConn sends and receives datagrams through a SOCKS5 UDP relay.
+// The relay lives as long as the TCP control connection stays open.
+type socks5PacketConn struct {
+	*net.UDPConn
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	msg, err := appendSocks5Addr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return
+	}
+	msg = append(msg, b...)
+	if _, err = c.UDPConn.WriteTo(msg, c.relay); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		var m int
+		m, _, err = c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// Drop fragments and anything too short to carry a header.
+		if m < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[4:m])
+		var from string
+		if from, err = readSocks5Addr(r, buf[3]); err != nil {
+			continue
+		}
+		if addr, err = net.ResolveUDPAddr("udp", from); err != nil {
+			continue
+		}
+		n = copy(b, buf[m-r.Len():m])
+		return
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+)
+
+// A StorageFactory creates the FileStore for a torrent and returns the total
+// size of its content. storePath is where the torrent's files belong, for
+// backends that keep them as separate files.
+type StorageFactory func(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error)
+
+var storageFlag string
+var blobPath string
+
+func init() {
+	flag.StringVar(&storageFlag, "storage", "file", "Where to store torrent data: file (one file per torrent file), "+
+		"mmap (memory mapped files, always fully allocated), memory (nothing touches the disk) or blob (everything in the single "+
+		"file or block device given by -blobPath).")
+	flag.StringVar(&blobPath, "blobPath", "", "Preallocated file or block device for -storage=blob.")
+}
+
+// storageFromFlags returns the StorageFactory chosen on the command line.
+func storageFromFlags() (factory StorageFactory, err error) {
+	switch storageFlag {
+	case "file":
+		factory = NewFileStore
+	case "mmap":
+		factory = NewMmapFileStore
+	case "memory":
+		factory = NewMemFileStore
+	case "blob":
+		if blobPath == "" {
+			return nil, errors.New("-storage=blob requires -blobPath.")
+		}
+		factory = BlobStorage(blobPath)
+	default:
+		err = errors.New("Unknown storage backend " + storageFlag)
+	}
+	return
+}
+
+func torrentLength(info *InfoDict) (totalSize int64) {
+	for _, f := range torrentFiles(info) {
+		totalSize += f.Length
+	}
+	return
+}
+
+// memFileStore keeps the whole torrent in memory. Good for tests and small
+// torrents.
+type memFileStore struct {
+	data []byte
+}
+
+func NewMemFileStore(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+	totalSize = torrentLength(info)
+	if int64(int(totalSize)) != totalSize || totalSize < 0 {
+		err = errors.New("Torrent is too large to keep in memory.")
+		return
+	}
+	f = &memFileStore{make([]byte, totalSize)}
+	return
+}
+
+func (m *memFileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < int64(len(m.data)) {
+		n = copy(p, m.data[off:])
+	}
+	// Reading past the end gives zeros, like the other stores.
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (m *memFileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < int64(len(m.data)) {
+		n = copy(m.data[off:], p)
+	}
+	for _, b := range p[n:] {
+		if b != 0 {
+			return n, errors.New("Unexpected non-zero data at end of store.")
+		}
+	}
+	return len(p), nil
+}
+
+func (m *memFileStore) Close() error {
+	m.data = nil
+	return nil
+}
+
+// blobFileStore writes the whole torrent, in order, into one file or block
+// device.
+type blobFileStore struct {
+	fd        *os.File
+	totalSize int64
+}
+
+// BlobStorage returns a StorageFactory that stores torrents in the file or
+// block device at path. A regular file is extended to the size of the
+// torrent; a device has to be big enough already.
+func BlobStorage(path string) StorageFactory {
+	return func(info *InfoDict, storePath string) (f FileStore, totalSize int64, err error) {
+		totalSize = torrentLength(info)
+		fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return
+		}
+		st, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return
+		}
+		if st.Mode().IsRegular() {
+			if st.Size() < totalSize {
+				err = fd.Truncate(totalSize)
+			}
+		} else {
+			// Devices report a size of 0, so seek to the end instead.
+			var size int64
+			if size, err = fd.Seek(0, io.SeekEnd); err == nil && size < totalSize {
+				err = errors.New("Device " + path + " is too small for the torrent.")
+			}
+		}
+		if err != nil {
+			fd.Close()
+			return
+		}
+		f = &blobFileStore{fd, totalSize}
+		return
+	}
+}
+
+func (b *blobFileStore) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < b.totalSize {
+		chunk := p
+		if int64(len(chunk)) > b.totalSize-off {
+			chunk = chunk[:b.totalSize-off]
+		}
+		if n, err = b.fd.ReadAt(chunk, off); err != nil {
+			return
+		}
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (b *blobFileStore) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < b.totalSize {
+		chunk := p
+		if int64(len(chunk)) > b.totalSize-off {
+			chunk = chunk[:b.totalSize-off]
+		}
+		if n, err = b.fd.WriteAt(chunk, off); err != nil {
+			return
+		}
+	}
+	for _, c := range p[n:] {
+		if c != 0 {
+			return n, errors.New("Unexpected non-zero data at end of store.")
+		}
+	}
+	return len(p), nil
+}
+
+func (b *blobFileStore) Close() error {
+	return b.fd.Close()
+}
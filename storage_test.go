@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+var storageTestInfo = InfoDict{
+	PieceLength: 16,
+	Name:        "test",
+	Files: []FileDict{
+		{Length: 10, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 20, Path: []string{"dir", "b"}},
+	},
+}
+
+func testStorage(t *testing.T, name string, newStore StorageFactory, storePath string) {
+	fs, totalSize, err := newStore(&storageTestInfo, storePath)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer fs.Close()
+	if totalSize != 30 {
+		t.Errorf("%s: wanted total size 30, got %d", name, totalSize)
+	}
+	// Straddles the first and last file.
+	data := []byte("0123456789abcdef")
+	if _, err = fs.WriteAt(data, 4); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	got := make([]byte, 32)
+	if _, err = fs.ReadAt(got, 0); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	want := append(append(make([]byte, 4), data...), make([]byte, 12)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: wanted %q, got %q", name, want, got)
+	}
+	if _, err = fs.WriteAt([]byte{1}, 30); err == nil {
+		t.Errorf("%s: writing data past the end should fail", name)
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStorage(t, "memory", NewMemFileStore, "")
+	testStorage(t, "file", NewFileStore, filepath.Join(dir, "file"))
+	testStorage(t, "blob", BlobStorage(filepath.Join(dir, "blob")), "")
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		testStorage(t, "mmap", NewMmapFileStore, filepath.Join(dir, "mmap"))
+	}
+}
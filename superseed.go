@@ -0,0 +1,88 @@
+package main
+
+// Super-seeding, for a seed that starts a new swarm. Instead of telling
+// every peer that we have all pieces, we tell each peer about one rare
+// piece at a time. We only offer it another piece once some other peer
+// reports having the one we gave it, so each piece we upload is passed on
+// before we upload more. The first complete copy reaches the swarm with
+// little more than one copy's worth of upload from us.
+
+import (
+	"flag"
+	"math/rand"
+)
+
+var superSeed bool
+
+func init() {
+	flag.BoolVar(&superSeed, "superSeed", false, "Super-seed: hand out one rare piece at a time to each peer, "+
+		"so a new torrent reaches the swarm with little upload from us. Only used when we start as a seed.")
+}
+
+// startSuperSeeding is called when the session starts as a seed.
+func (t *TorrentSession) startSuperSeeding() {
+	if superSeed && t.downloadComplete() {
+		t.logger(sessionLog).Info("Super-seeding")
+		t.superSeeding = true
+	}
+}
+
+// superSeedChoose picks the piece to offer a peer next: one it doesn't
+// have, and that as few other peers have or were offered as possible.
+// Returns -1 if there is nothing left to offer.
+func (t *TorrentSession) superSeedChoose(p *peerState) (piece int) {
+	counts := t.pieceAvailability()
+	for _, q := range t.peers {
+		if q.superSeedPiece >= 0 {
+			counts[q.superSeedPiece]++
+		}
+	}
+	piece = -1
+	if t.totalPieces == 0 {
+		return
+	}
+	// Start at a random piece, so ties don't all go the same way.
+	start := rand.Intn(t.totalPieces)
+	for i := 0; i < t.totalPieces; i++ {
+		c := (start + i) % t.totalPieces
+		if !t.pieceSet.IsSet(c) || p.superSeedOffered[c] || (p.have != nil && p.have.IsSet(c)) {
+			continue
+		}
+		if piece < 0 || counts[c] < counts[piece] {
+			piece = c
+		}
+	}
+	return
+}
+
+// superSeedOffer tells a peer about the next piece it may download from us.
+func (t *TorrentSession) superSeedOffer(p *peerState) {
+	p.superSeedPiece = t.superSeedChoose(p)
+	if p.superSeedPiece < 0 {
+		return
+	}
+	if p.superSeedOffered == nil {
+		p.superSeedOffered = make(map[int]bool)
+	}
+	p.superSeedOffered[p.superSeedPiece] = true
+	p.sendHave(p.superSeedPiece)
+}
+
+// superSeedSawHave is called when a peer reports having a piece. Whoever
+// we offered that piece to has passed it on, and gets a new one.
+func (t *TorrentSession) superSeedSawHave(from *peerState, piece int) {
+	for _, p := range t.peers {
+		if p != from && p.superSeedPiece == piece {
+			t.superSeedOffer(p)
+		}
+	}
+}
+
+// mayUpload is whether a peer may request a piece from us. While
+// super-seeding, peers only get the pieces we offered them.
+func (t *TorrentSession) mayUpload(p *peerState, piece int) bool {
+	if !t.pieceSet.IsSet(piece) {
+		return false
+	}
+	return !t.superSeeding || p.superSeedOffered[piece]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSuperSeed(t *testing.T) {
+	ts := &TorrentSession{peers: make(map[string]*peerState), totalPieces: 4,
+		pieceSet: NewBitset(4), superSeeding: true}
+	for i := 0; i < 4; i++ {
+		ts.pieceSet.Set(i)
+	}
+	var peers []*peerState
+	for _, address := range []string{"a:1", "b:1", "c:1"} {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		p := NewPeerState(c1)
+		p.address = address
+		p.have = NewBitset(4)
+		ts.peers[address] = p
+		peers = append(peers, p)
+	}
+	a, b, c := peers[0], peers[1], peers[2]
+	a.have.Set(0)
+	b.have.Set(0)
+	b.have.Set(1)
+
+	ts.superSeedOffer(c)
+	if c.superSeedPiece != 2 && c.superSeedPiece != 3 {
+		t.Fatalf("Offered piece %d, wanted one nobody has", c.superSeedPiece)
+	}
+	ts.superSeedOffer(a)
+	if a.superSeedPiece+c.superSeedPiece != 5 {
+		t.Errorf("Offered %d and %d, wanted 2 and 3", a.superSeedPiece, c.superSeedPiece)
+	}
+	if !ts.mayUpload(a, a.superSeedPiece) || ts.mayUpload(a, c.superSeedPiece) {
+		t.Errorf("Peers may only download what they were offered")
+	}
+
+	// a's piece shows up at b, so a gets another one.
+	first := a.superSeedPiece
+	a.have.Set(first)
+	ts.superSeedSawHave(a, first)
+	if a.superSeedPiece != first {
+		t.Errorf("Offered a new piece before the last one spread")
+	}
+	b.have.Set(first)
+	ts.superSeedSawHave(b, first)
+	if a.superSeedPiece == first || a.superSeedPiece < 0 {
+		t.Errorf("No new piece after the last one spread, got %d", a.superSeedPiece)
+	}
+	if !ts.mayUpload(a, first) {
+		t.Errorf("Earlier offers should still be served")
+	}
+}
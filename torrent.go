@@ -2,16 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strconv"
 	"time"
 
@@ -42,6 +42,7 @@ const (
 
 // Should be overriden by flag. Not thread safe.
 var port int
+var announcePort int
 var useUPnP bool
 var fileDir string
 var useDHT bool
@@ -53,6 +54,8 @@ func init() {
 	// running on port 0 because ListenUDP doesn't do that.
 	// Don't use port 6881 which blacklisted by some trackers.
 	flag.IntVar(&port, "port", 7777, "Port to listen on.")
+	flag.IntVar(&announcePort, "announcePort", 0, "Port to announce to trackers, if not the one we listen on. "+
+		"Use it when a relay or port forward delivers incoming connections to -port.")
 	flag.BoolVar(&useUPnP, "useUPnP", false, "Use UPnP to open port in firewall.")
 	flag.BoolVar(&useDHT, "useDHT", false, "Use DHT to get peers.")
 	flag.BoolVar(&trackerLessMode, "trackerLessMode", false, "Do not get peers from the tracker. Good for "+
@@ -64,62 +67,83 @@ func peerId() string {
 	return sid[0:20]
 }
 
-func chooseListenPort() (listenPort int, err error) {
+// chooseListenPort returns the port to listen on, and the NAT it is mapped
+// through if we used UPnP.
+func chooseListenPort() (listenPort int, nat NAT, err error) {
 	listenPort = port
 	if useUPnP {
-		log.Println("Using UPnP to open port.")
+		upnpLog.Info("Using UPnP to open port")
 		// TODO: Look for ports currently in use. Handle collisions.
-		var nat NAT
-		nat, err = Discover()
+		var n NAT
+		n, err = Discover()
 		if err != nil {
-			log.Println("Unable to discover NAT:", err)
+			upnpLog.Error("Unable to discover NAT", "err", err)
 			return
 		}
 		// TODO: Check if the port is already mapped by someone else.
-		err2 := nat.DeletePortMapping("TCP", listenPort)
+		err2 := n.DeletePortMapping("TCP", listenPort)
 		if err2 != nil {
-			log.Println("Unable to delete port mapping", err2)
+			upnpLog.Warn("Unable to delete port mapping", "port", listenPort, "err", err2)
 		}
-		err = nat.AddPortMapping("TCP", listenPort, listenPort,
+		err = n.AddPortMapping("TCP", listenPort, listenPort,
 			"Taipei-Torrent port "+strconv.Itoa(listenPort), 0)
 		if err != nil {
-			log.Println("Unable to forward listen port", err)
+			upnpLog.Error("Unable to forward listen port", "port", listenPort, "err", err)
 			return
 		}
+		nat = n
 	}
 	return
 }
 
 func (t *TorrentSession) listenForPeerConnections(conChan chan net.Conn) {
-	listenString := ":" + strconv.Itoa(t.si.Port)
+	listenString := ":" + strconv.Itoa(t.listenPort)
 	listener, err := net.Listen("tcp", listenString)
+	if err != nil && t.listenPort != 0 {
+		// Another session may have the port.
+		t.logger(peerLog).Warn("Could not listen on port, using any free port", "port", t.listenPort, "err", err)
+		t.listenPort = 0
+		listener, err = net.Listen("tcp", ":0")
+	}
 	if err != nil {
-		log.Fatal("Listen failed:", err)
+		t.logger(peerLog).Fatal("Listen failed", "err", err)
 	}
 
 	// If port was not set by UPnP, and was 0, get the actual port
-	if t.si.Port == 0 {
+	if t.listenPort == 0 {
 		// so we can send it to trackers.
 		_, p, err := net.SplitHostPort(listener.Addr().String())
 		if err == nil {
-			t.si.Port, err = strconv.Atoi(p)
+			t.listenPort, err = strconv.Atoi(p)
 		}
 
 		if err != nil {
-			log.Fatal("net.Listen() gave us an invalid port: ", err)
+			t.logger(peerLog).Fatal("net.Listen() gave us an invalid port", "err", err)
+		}
+		if announcePort == 0 {
+			t.si.Port = t.listenPort
 		}
 	}
 
-	log.Println("Listening for peers on port:", t.si.Port)
+	t.logger(peerLog).Info("Listening for peers", "port", t.listenPort)
+	t.listener = listener
 	go func() {
 		for {
-			var conn net.Conn
-			conn, err = listener.Accept()
+			conn, err := listener.Accept()
 			if err != nil {
-				log.Println("Listener failed:", err)
-			} else {
-				// log.Println("A peer contacted us", conn.RemoteAddr().String())
-				conChan <- conn
+				if t.ctx.Err() != nil {
+					// Closed by shutdown.
+					return
+				}
+				t.logger(peerLog).Error("Listener failed", "err", err)
+				continue
+			}
+			t.logger(peerLog).Debug("A peer contacted us", "peer", conn.RemoteAddr())
+			select {
+			case conChan <- conn:
+			case <-t.ctx.Done():
+				conn.Close()
+				return
 			}
 		}
 	}()
@@ -131,8 +155,14 @@ var kBitTorrentHeader = []byte{'\x13', 'B', 'i', 't', 'T', 'o', 'r',
 func string2Bytes(s string) []byte { return bytes.NewBufferString(s).Bytes() }
 
 type ActivePiece struct {
+	index           int
 	downloaderCount []int // -1 means piece is already downloaded
 	pieceLength     int
+	blocks          [][]byte // Downloaded blocks that are not on disk yet
+	flushed         bool     // Some blocks were written before the piece was complete
+	writing         bool     // Complete, and waiting for the disk writer
+	sources         []string // Address of the peer whose copy of each block we kept
+	pinned          string   // If set, only this peer may download the piece
 }
 
 func (a *ActivePiece) chooseBlockToDownload(endgame bool) (index int) {
@@ -171,6 +201,13 @@ func (a *ActivePiece) recordBlock(index int) (requestCount int) {
 	return
 }
 
+func (a *ActivePiece) cachedBytes() (n int64) {
+	for _, b := range a.blocks {
+		n += int64(len(b))
+	}
+	return
+}
+
 func (a *ActivePiece) isComplete() bool {
 	for _, v := range a.downloaderCount {
 		if v != -1 {
@@ -181,91 +218,224 @@ func (a *ActivePiece) isComplete() bool {
 }
 
 type TorrentSession struct {
-	m               *MetaInfo
-	si              *SessionInfo
-	ti              *TrackerResponse
-	fileStore       FileStore
-	trackerInfoChan chan *TrackerResponse
-	peers           map[string]*peerState
-	peerMessageChan chan peerMessage
-	pieceSet        *Bitset // The pieces we have
-	totalPieces     int
-	totalSize       int64
-	lastPieceLength int
-	goodPieces      int
-	activePieces    map[int]*ActivePiece
-	lastHeartBeat   time.Time
-	dht             *dht.DHT
-}
-
-func NewTorrentSession(torrent string) (ts *TorrentSession, err error) {
-
-	var listenPort int
-	if listenPort, err = chooseListenPort(); err != nil {
-		log.Println("Could not choose listen port.")
-		log.Println("Peer connectivity will be affected.")
-	}
-	t := &TorrentSession{peers: make(map[string]*peerState),
-		peerMessageChan: make(chan peerMessage),
-		activePieces:    make(map[int]*ActivePiece)}
-	t.m, err = getMetaInfo(torrent)
+	m                *MetaInfo
+	si               *SessionInfo
+	ti               *TrackerResponse
+	fileStore        FileStore
+	trackerInfoChan  chan *TrackerResponse
+	peers            map[string]*peerState
+	peerMessageChan  chan peerMessage
+	pieceSet         *Bitset // The pieces we have
+	totalPieces      int
+	totalSize        int64
+	lastPieceLength  int
+	goodPieces       int
+	wantedPieces     *Bitset // The pieces we want to download. nil means all of them.
+	activePieces     map[int]*ActivePiece
+	lastHeartBeat    time.Time
+	dht              *dht.DHT
+	listenPort       int
+	uploadLimit      *tokenBucket
+	downloadLimit    *tokenBucket
+	diskReads        chan *diskRead
+	diskReadsDone    chan *diskRead
+	diskReadBacklog  bool // Some peer requests are waiting for a free disk reader
+	diskWrites       chan *diskWrite
+	diskWritesDone   chan *diskWrite
+	diskWritesGone   chan struct{} // Closed when shutdown stops waiting for the disk writer
+	cacheUsed        int64         // Bytes of downloaded data not yet on disk
+	movedToCompleted bool
+	badPieces        map[int]*badPiece // Pieces that failed, until they are downloaded again
+	strikes          map[string]int    // Times each host sent us bad data
+	banned           map[string]bool   // Hosts we won't talk to
+	blocklistVersion int               // Of the blocklist the current peers were checked against
+	candidates       map[string]*peerCandidate
+	halfOpen         int // Dials in progress
+	dialResults      chan *dialResult
+	ctx              context.Context // Done once Stop is called
+	cancel           context.CancelFunc
+	listener         net.Listener
+	nat              NAT // The port is mapped through this, if not nil
+	seeding          seedingState
+	lastPortAnnounce time.Time   // When we last announced because the proxy's port changed
+	superSeeding     bool        // Offer one piece at a time instead of everything we have
+	control          chan func() // Run on the main goroutine, see do
+	storeSkip        []bool      // Files the store was opened without
+	filePriorities   []int       // nil until a priority is set
+	tracker          trackerState
+	metrics          sessionMetrics
+	rates            sessionRates
+	choke            chokeState
+}
+
+// NewTorrentSession opens a torrent and checks which pieces of it we already
+// have. newStore chooses where the data is kept; nil means NewFileStore.
+func NewTorrentSession(torrent string, newStore StorageFactory) (ts *TorrentSession, err error) {
+	m, err := getMetaInfo(torrent)
 	if err != nil {
 		return
 	}
-	log.Printf("Tracker: %v, Comment: %v, InfoHash: %x, Encoding: %v, Private: %v",
-		t.m.Announce, t.m.Comment, t.m.InfoHash, t.m.Encoding, t.m.Info.Private)
+	return newTorrentSession(m, newStore)
+}
+
+// newTorrentSession is NewTorrentSession for a torrent we have already
+// read. If it fails, nothing is left open.
+func newTorrentSession(m *MetaInfo, newStore StorageFactory) (ts *TorrentSession, err error) {
+	t := &TorrentSession{m: m, peers: make(map[string]*peerState),
+		peerMessageChan: make(chan peerMessage),
+		activePieces:    make(map[int]*ActivePiece),
+		badPieces:       make(map[int]*badPiece),
+		strikes:         make(map[string]int),
+		banned:          make(map[string]bool),
+		candidates:      make(map[string]*peerCandidate),
+		dialResults:     make(chan *dialResult),
+		control:         make(chan func()),
+		uploadLimit:     newTokenBucket(0),
+		downloadLimit:   newTokenBucket(0)}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			t.discard()
+		}
+	}()
+	if t.listenPort, t.nat, err = chooseListenPort(); err != nil {
+		upnpLog.Warn("Could not choose listen port. Peer connectivity will be affected.", "err", err)
+		err = nil
+	}
+	t.logger(sessionLog).Info("Opened torrent", "tracker", t.m.Announce, "comment", t.m.Comment,
+		"encoding", t.m.Encoding, "private", t.m.Info.Private)
 	if e := t.m.Encoding; e != "" && e != "UTF-8" {
 		return nil, errors.New(fmt.Sprintf("Unknown encoding %s", e))
 	}
-	ext := ".torrent"
-	dir := fileDir
-	if len(t.m.Info.Files) != 0 {
-		dir += "/" + filepath.Base(torrent)
-		if dir[len(dir)-len(ext):] == ext {
-			dir = dir[:len(dir)-len(ext)]
-		}
+	dir, err := torrentStoreDir(&t.m.Info)
+	if err != nil {
+		return
 	}
-
-	t.fileStore, t.totalSize, err = NewFileStore(&t.m.Info, dir)
+	if newStore == nil {
+		newStore = NewFileStore
+	}
+	t.fileStore, t.totalSize, err = newStore(&t.m.Info, dir)
 	if err != nil {
 		return
 	}
 	t.lastPieceLength = int(t.totalSize % t.m.Info.PieceLength)
 
-	start := time.Now()
-	good, bad, pieceSet, err := checkPieces(t.fileStore, t.totalSize, t.m)
-	end := time.Now()
-	log.Printf("Computed missing pieces (%.2f seconds)", end.Sub(start).Seconds())
-	if err != nil {
-		return
+	var good, bad int
+	pieceSet := readResume(t.m, t.fileStore, t.totalSize)
+	if pieceSet != nil {
+		good = pieceSet.Count()
+		bad = pieceSet.n - good
+		t.logger(storageLog).Info("Using resume data instead of checking pieces")
+	} else {
+		start := time.Now()
+		good, bad, pieceSet, err = checkPieces(t.fileStore, t.totalSize, t.m)
+		t.logger(storageLog).Info("Computed missing pieces", "duration", time.Now().Sub(start))
+		if err != nil {
+			return
+		}
 	}
 	t.pieceSet = pieceSet
 	t.totalPieces = good + bad
 	t.goodPieces = good
-	log.Println("Good pieces:", good, "Bad pieces:", bad)
+	t.logger(storageLog).Info("Checked pieces", "good", good, "bad", bad)
+
+	skip, err := parseSkipFiles(skipFiles, len(torrentFiles(&t.m.Info)))
+	if err != nil {
+		return
+	}
+	t.storeSkip = skip
+	t.wantedPieces = wantedPieces(&t.m.Info, skip, t.totalPieces)
+	if seedOnly {
+		t.wantedPieces = seedOnlyPieces(t.pieceSet)
+	}
+	t.seeding.goals = defaultSeedingGoals()
 
 	left := int64(bad) * int64(t.m.Info.PieceLength)
 	if !t.pieceSet.IsSet(t.totalPieces - 1) {
 		left = left - t.m.Info.PieceLength + int64(t.lastPieceLength)
 	}
-	t.si = &SessionInfo{PeerId: peerId(), Port: listenPort, Left: left}
+	t.si = &SessionInfo{PeerId: peerId(), Port: t.listenPort, Left: left}
+	if announcePort != 0 {
+		t.si.Port = announcePort
+	}
 	if useDHT {
 		// TODO: UPnP UDP port mapping.
-		if t.dht, err = dht.NewDHTNode(listenPort, TARGET_NUM_PEERS, true); err != nil {
-			log.Println("DHT node creation error", err)
+		if t.dht, err = dht.NewDHTNode(t.listenPort, TARGET_NUM_PEERS, true); err != nil {
+			t.logger(dhtLog).Error("DHT node creation error", "err", err)
 			return
 		}
-		go t.dht.DoDHT()
 	}
 	return t, err
 }
 
+// discard releases what a session that never ran holds.
+func (t *TorrentSession) discard() {
+	t.cancel()
+	if t.fileStore != nil {
+		t.fileStore.Close()
+	}
+	if t.nat != nil {
+		t.nat.DeletePortMapping("TCP", t.listenPort)
+	}
+}
+
+// torrentStoreDir returns the storePath for a torrent: the directory its file
+// goes in, or the directory named after it that holds its files.
+func torrentStoreDir(info *InfoDict) (dir string, err error) {
+	name, err := torrentName(info)
+	if err != nil {
+		return
+	}
+	dir = fileDir
+	if len(info.Files) != 0 {
+		dir = path.Join(fileDir, name)
+	}
+	dir = completedStoreDir(info, dir)
+	return
+}
+
+// SetRateLimits changes this session's upload and download limits, in bytes
+// per second. 0 means unlimited. The global limits still apply on top.
+// Safe to call from any goroutine.
+func (t *TorrentSession) SetRateLimits(up, down int) {
+	t.uploadLimit.SetRate(up)
+	t.downloadLimit.SetRate(down)
+}
+
 func (t *TorrentSession) fetchTrackerInfo(event string) {
+	u, err := t.announceURL(event)
+	if err != nil {
+		t.logger(trackerLog).Error("Invalid announce URL", "url", t.m.Announce, "err", err)
+		return
+	}
+	ch := t.trackerInfoChan
+	go func() {
+		start := time.Now()
+		ti, err := getTrackerInfo(u)
+		t.metrics.announced(time.Now().Sub(start), ti == nil || err != nil || ti.FailureReason != "")
+		if ti == nil || err != nil {
+			t.logger(trackerLog).Error("Could not fetch tracker info", "err", err)
+			t.announced(fmt.Sprint("Could not fetch tracker info: ", err))
+		} else if ti.FailureReason != "" {
+			t.logger(trackerLog).Error("Tracker returned failure reason", "reason", ti.FailureReason)
+			t.announced(ti.FailureReason)
+		} else {
+			t.announced("")
+			select {
+			case ch <- ti:
+			case <-t.ctx.Done():
+			}
+		}
+	}()
+}
+
+func (t *TorrentSession) announceURL(event string) (announce string, err error) {
 	m, si := t.m, t.si
-	log.Println("Stats: Uploaded", si.Uploaded, "Downloaded", si.Downloaded, "Left", si.Left)
+	t.logger(trackerLog).Info("Announcing", "event", event, "uploaded", si.Uploaded, "downloaded", si.Downloaded,
+		"left", si.Left)
 	u, err := url.Parse(m.Announce)
 	if err != nil {
-		log.Println("Error: Invalid announce URL(", m.Announce, "):", err)
+		return
 	}
 	uq := u.Query()
 	uq.Add("info_hash", m.InfoHash)
@@ -275,6 +445,11 @@ func (t *TorrentSession) fetchTrackerInfo(event string) {
 	uq.Add("downloaded", strconv.FormatInt(si.Downloaded, 10))
 	uq.Add("left", strconv.FormatInt(si.Left, 10))
 	uq.Add("compact", "1")
+	if t.seeding.complete {
+		// Leechers find us. We don't need anyone.
+		uq.Add("numwant", "0")
+	}
+	uq.Add("no_peer_id", "1")
 
 	if event != "" {
 		uq.Add("event", event)
@@ -285,69 +460,82 @@ func (t *TorrentSession) fetchTrackerInfo(event string) {
 	// properly.
 
 	u.RawQuery = uq.Encode()
-
-	ch := t.trackerInfoChan
-	go func() {
-		ti, err := getTrackerInfo(u.String())
-		if ti == nil || err != nil {
-			log.Println("Error: Could not fetch tracker info:", err)
-		} else if ti.FailureReason != "" {
-			log.Println("Error: Tracker returned failure reason:", ti.FailureReason)
-		} else {
-			ch <- ti
-		}
-	}()
+	return u.String(), nil
 }
 
-func connectToPeer(peer string, ch chan net.Conn) {
-	// log.Println("Connecting to", peer)
-	conn, err := proxyNetDial("tcp", peer)
-	if err != nil {
-		// log.Println("Failed to connect to", peer, err)
-	} else {
-		// log.Println("Connected to", peer)
-		ch <- conn
-	}
+// AddPeer takes a connection a peer made to us.
+func (t *TorrentSession) AddPeer(conn net.Conn) {
+	t.addPeer(conn, SOURCE_INCOMING)
 }
 
-func (t *TorrentSession) AddPeer(conn net.Conn) {
+func (t *TorrentSession) addPeer(conn net.Conn, source string) {
 	peer := conn.RemoteAddr().String()
-	// log.Println("Adding peer", peer)
-	if len(t.peers) >= MAX_NUM_PEERS {
-		log.Println("We have enough peers. Rejecting additional peer", peer)
+	l := t.logger(peerLog).With("peer", peer)
+	l.Debug("Adding peer", "source", source)
+	if !t.mayConnect(peer) {
+		l.Info("Rejecting banned or blocked peer")
+		conn.Close()
+		return
+	}
+	if t.seeding.paused {
+		conn.Close()
+		return
+	}
+	if _, ok := t.peers[peer]; ok {
+		l.Debug("Already connected")
+		conn.Close()
+		return
+	}
+	if len(t.peers) >= maxPeers || !reservePeer() {
+		l.Info("We have enough peers. Rejecting additional peer")
 		conn.Close()
 		return
 	}
 	ps := NewPeerState(conn)
 	ps.address = peer
+	ps.source = source
+	ps.log = l
+	ps.uploadLimits = []*tokenBucket{t.uploadLimit, globalUploadLimit}
+	ps.downloadLimits = []*tokenBucket{t.downloadLimit, globalDownloadLimit}
 	var header [68]byte
 	copy(header[0:], kBitTorrentHeader[0:])
 	if t.m.Info.Private != 1 && useDHT {
 		header[27] = header[27] | 0x01
 	}
+	header[20+extensionByte] |= extensionBit
 	copy(header[28:48], string2Bytes(t.m.InfoHash))
 	copy(header[48:68], string2Bytes(t.si.PeerId))
 
 	t.peers[peer] = ps
-	go ps.peerWriter(t.peerMessageChan, header[0:])
-	go ps.peerReader(t.peerMessageChan)
-	ps.SetChoke(false) // TODO: better choke policy
+	go ps.peerWriter(t.peerMessageChan, t.ctx.Done(), header[0:])
+	go ps.peerReader(t.peerMessageChan, t.ctx.Done())
+	if t.goodPieces > 0 && !t.superSeeding {
+		ps.sendBitfield(t.pieceSet)
+	}
 }
 
 func (t *TorrentSession) ClosePeer(peer *peerState) {
-	log.Println("Closing peer", peer.address)
+	peer.log.Info("Closed peer")
 	_ = t.removeRequests(peer)
 	peer.Close()
-	delete(t.peers, peer.address)
+	if t.peers[peer.address] == peer {
+		delete(t.peers, peer.address)
+		releasePeer()
+		t.peerClosed(peer.address)
+	}
 }
 
 func (t *TorrentSession) deadlockDetector() {
 	for {
-		time.Sleep(15 * time.Second)
+		select {
+		case <-time.After(15 * time.Second):
+		case <-t.ctx.Done():
+			return
+		}
 		age := time.Now().Sub(t.lastHeartBeat)
 		if age > 15*time.Second {
-			log.Println("Starvation or deadlock of main thread detected. Look in the stack dump for what DoTorrent() is currently doing.")
-			log.Println("Last heartbeat", age.Seconds(), "seconds ago")
+			t.logger(sessionLog).Error("Starvation or deadlock of main thread detected. Look in the stack dump for "+
+				"what DoTorrent() is currently doing.", "lastHeartbeat", age)
 			panic("Killed by deadlock detector")
 		}
 	}
@@ -356,30 +544,48 @@ func (t *TorrentSession) deadlockDetector() {
 func (t *TorrentSession) DoTorrent() (err error) {
 	t.lastHeartBeat = time.Now()
 	go t.deadlockDetector()
-	log.Println("Fetching torrent.")
+	if t.dht != nil {
+		go t.dht.DoDHT()
+	}
+	t.logger(sessionLog).Info("Fetching torrent")
 	rechokeChan := time.Tick(1 * time.Second)
 	// Start out polling tracker every 20 seconds untill we get a response.
 	// Maybe be exponential backoff here?
 	retrackerChan := time.Tick(20 * time.Second)
 	keepAliveChan := time.Tick(60 * time.Second)
 	t.trackerInfoChan = make(chan *TrackerResponse)
+	t.startDiskReaders()
+	t.startDiskWriter()
 
 	conChan := make(chan net.Conn)
-	if useProxy() {
-		// Only listen for peer connections if not using a proxy.
+	portChan := make(chan int)
+	switch {
+	case !useProxy() || announcePort != 0:
+		// A relay in front of the proxy forwards peers to our own listener.
 		t.listenForPeerConnections(conChan)
+	case proxyBind:
+		go acceptThroughProxy(t.ctx, conChan, portChan)
+	default:
+		// Only listen for peer connections if not using a proxy. Nobody can
+		// reach us, but trackers want a port, so we still announce -port.
 	}
 
 	if t.m.Info.Private != 1 && useDHT {
 		t.dht.PeersRequest(t.m.InfoHash, true)
+		t.metrics.count(&t.metrics.dhtRequests, 1)
 	}
 
+	if t.downloadComplete() {
+		t.moveCompleted()
+		t.enterSeedingMode()
+		t.startSuperSeeding()
+	}
 	t.fetchTrackerInfo("started")
 
 	for {
 		select {
 		case _ = <-retrackerChan:
-			if !trackerLessMode {
+			if !trackerLessMode && !t.seeding.paused {
 				t.fetchTrackerInfo("")
 			}
 		case dhtInfoHashPeers := <-t.dht.PeersRequestResults:
@@ -388,39 +594,39 @@ func (t *TorrentSession) DoTorrent() (err error) {
 			// supports one download at a time, so let's assume
 			// it's the case.
 			for _, peers := range dhtInfoHashPeers {
+				t.metrics.count(&t.metrics.dhtPeers, len(peers))
 				for _, peer := range peers {
 					peer = dht.DecodePeerAddress(peer)
-					if _, ok := t.peers[peer]; !ok {
+					if t.addCandidate(peer, SOURCE_DHT) {
 						newPeerCount++
-						go connectToPeer(peer, conChan)
 					}
 				}
 			}
-			// log.Println("Contacting", newPeerCount, "new peers (thanks DHT!)")
+			t.dialCandidates()
+			t.logger(dhtLog).Debug("Contacting new peers", "count", newPeerCount)
 		case ti := <-t.trackerInfoChan:
 			t.ti = ti
-			log.Println("Torrent has", t.ti.Complete, "seeders and", t.ti.Incomplete, "leachers.")
+			l := t.logger(trackerLog)
+			l.Info("Tracker answered", "seeders", t.ti.Complete, "leechers", t.ti.Incomplete)
 			if !trackerLessMode {
 				peers := t.ti.Peers
-				log.Println("Tracker gave us", len(peers)/6, "peers")
+				l.Info("Tracker gave us peers", "count", len(peers)/6)
 				newPeerCount := 0
 				for i := 0; i < len(peers); i += 6 {
 					peer := nettools.BinaryToDottedPort(peers[i : i+6])
-					if _, ok := t.peers[peer]; !ok {
+					if t.addCandidate(peer, SOURCE_TRACKER) {
 						newPeerCount++
-						go connectToPeer(peer, conChan)
 					}
 				}
-				log.Println("Contacting", newPeerCount, "new peers")
+				t.dialCandidates()
+				l.Info("Contacting new peers", "count", newPeerCount)
 				interval := t.ti.Interval
 				if interval < 120 {
 					interval = 120
 				} else if interval > 24*3600 {
 					interval = 24 * 3600
 				}
-				log.Println("..checking again in", interval, "seconds.")
 				retrackerChan = time.Tick(interval * time.Second)
-				log.Println("Contacting", newPeerCount, "new peers")
 			}
 			interval := t.ti.Interval
 			if interval < 120 {
@@ -428,7 +634,7 @@ func (t *TorrentSession) DoTorrent() (err error) {
 			} else if interval > 24*3600 {
 				interval = 24 * 3600
 			}
-			log.Println("..checking again in", interval.String())
+			l.Info("Checking again later", "interval", interval*time.Second)
 			retrackerChan = time.Tick(interval * time.Second)
 
 		case pm := <-t.peerMessageChan:
@@ -437,25 +643,60 @@ func (t *TorrentSession) DoTorrent() (err error) {
 			err2 := t.DoMessage(peer, message)
 			if err2 != nil {
 				if err2 != io.EOF {
-					log.Println("Closing peer", peer.address, "because", err2)
+					peer.log.Info("Closing peer", "err", err2)
 				}
 				t.ClosePeer(peer)
 			}
+		case <-t.ctx.Done():
+			return t.shutdown()
 		case conn := <-conChan:
 			t.AddPeer(conn)
+		case r := <-t.dialResults:
+			t.dialDone(r)
+		case f := <-t.control:
+			f()
+		case w := <-t.diskWritesDone:
+			t.diskWriteDone(w)
+		case r := <-t.diskReadsDone:
+			if err2 := t.sendRequest(r); err2 != nil {
+				t.ClosePeer(r.peer)
+			}
+			t.restartDiskReads()
+		case p := <-portChan:
+			if p != t.si.Port {
+				t.logger(peerLog).Info("Proxy is accepting peers for us", "port", p)
+				t.si.Port = p
+				// Otherwise the next regular announce has the port.
+				if !trackerLessMode && time.Now().Sub(t.lastPortAnnounce) >= proxyPortAnnounceInterval {
+					t.lastPortAnnounce = time.Now()
+					t.fetchTrackerInfo("")
+				}
+			}
 		case _ = <-rechokeChan:
-			// TODO: recalculate who to choke / unchoke
 			t.lastHeartBeat = time.Now()
 			ratio := float64(0.0)
 			if t.si.Downloaded > 0 {
 				ratio = float64(t.si.Uploaded) / float64(t.si.Downloaded)
 			}
-			log.Println("Peers:", len(t.peers), "downloaded:", t.si.Downloaded,
-				"uploaded:", t.si.Uploaded, "ratio", ratio)
-			log.Println("good, total", t.goodPieces, t.totalPieces)
-			if len(t.peers) < TARGET_NUM_PEERS && t.goodPieces < t.totalPieces {
+			if !statusDisplayed() {
+				t.logger(sessionLog).Info("Status", "peers", len(t.peers), "downloaded", t.si.Downloaded,
+					"uploaded", t.si.Uploaded, "ratio", ratio, "good", t.goodPieces, "total", t.totalPieces)
+			}
+			for _, p := range t.peers {
+				p.updatePipeline(1 * time.Second)
+			}
+			t.updateRates(time.Now())
+			t.rechoke(time.Now())
+			t.dialCandidates()
+			if v := currentBlocklistVersion(); v != t.blocklistVersion {
+				t.blocklistVersion = v
+				t.closeBlockedPeers()
+			}
+			t.checkSeedingGoals(time.Now())
+			if len(t.peers) < TARGET_NUM_PEERS && !t.downloadComplete() && !t.seeding.paused {
 				if t.m.Info.Private != 1 && useDHT {
 					go t.dht.PeersRequest(t.m.InfoHash, true)
+					t.metrics.count(&t.metrics.dhtRequests, 1)
 				}
 				if !trackerLessMode {
 					if t.ti == nil || t.ti.Complete > 100 {
@@ -467,14 +708,14 @@ func (t *TorrentSession) DoTorrent() (err error) {
 			now := time.Now()
 			for _, peer := range t.peers {
 				if peer.lastReadTime.Second() != 0 && now.Sub(peer.lastReadTime) > 3*time.Minute {
-					// log.Println("Closing peer", peer.address, "because timed out.")
+					peer.log.Info("Closing peer", "err", "timed out")
 					t.ClosePeer(peer)
 					continue
 				}
 				err2 := t.doCheckRequests(peer)
 				if err2 != nil {
 					if err2 != io.EOF {
-						log.Println("Closing peer", peer.address, "because", err2)
+						peer.log.Info("Closing peer", "err", err2)
 					}
 					t.ClosePeer(peer)
 					continue
@@ -483,12 +724,28 @@ func (t *TorrentSession) DoTorrent() (err error) {
 			}
 		}
 	}
+}
+
+// fillPipeline requests blocks from the peer until it has maxRequests of
+// ours outstanding, or has nothing more we want.
+func (t *TorrentSession) fillPipeline(p *peerState) (err error) {
+	for !p.peer_choking && len(p.our_requests) < p.maxRequests && !t.cacheFull() {
+		n := len(p.our_requests)
+		err = t.RequestBlock(p)
+		if err == io.EOF {
+			// Nothing left to ask this peer for.
+			return nil
+		}
+		if err != nil || len(p.our_requests) == n {
+			return
+		}
+	}
 	return
 }
 
 func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
-	for k, _ := range t.activePieces {
-		if p.have.IsSet(k) {
+	for k, v := range t.activePieces {
+		if p.have.IsSet(k) && t.mayDownload(p, v) {
 			err = t.RequestBlock2(p, k, false)
 			if err != io.EOF {
 				return
@@ -499,8 +756,8 @@ func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 	piece := t.ChoosePiece(p)
 	if piece < 0 {
 		// No unclaimed pieces. See if we can double-up on an active piece
-		for k, _ := range t.activePieces {
-			if p.have.IsSet(k) {
+		for k, v := range t.activePieces {
+			if p.have.IsSet(k) && t.mayDownload(p, v) {
 				err = t.RequestBlock2(p, k, true)
 				if err != io.EOF {
 					return
@@ -514,7 +771,12 @@ func (t *TorrentSession) RequestBlock(p *peerState) (err error) {
 			pieceLength = t.lastPieceLength
 		}
 		pieceCount := (pieceLength + STANDARD_BLOCK_LENGTH - 1) / STANDARD_BLOCK_LENGTH
-		t.activePieces[piece] = &ActivePiece{make([]int, pieceCount), pieceLength}
+		v := &ActivePiece{index: piece, downloaderCount: make([]int, pieceCount),
+			pieceLength: pieceLength, sources: make([]string, pieceCount)}
+		if _, ok := t.badPieces[piece]; ok {
+			v.pinned = p.address
+		}
+		t.activePieces[piece] = v
 		return t.RequestBlock2(p, piece, false)
 	} else {
 		p.SetInterested(false)
@@ -534,7 +796,7 @@ func (t *TorrentSession) ChoosePiece(p *peerState) (piece int) {
 
 func (t *TorrentSession) checkRange(p *peerState, start, end int) (piece int) {
 	for i := start; i < end; i++ {
-		if (!t.pieceSet.IsSet(i)) && p.have.IsSet(i) {
+		if (!t.pieceSet.IsSet(i)) && p.have.IsSet(i) && t.pieceWanted(i) && t.mayRetry(p, i) {
 			if _, ok := t.activePieces[i]; !ok {
 				return i
 			}
@@ -569,7 +831,10 @@ func (t *TorrentSession) requestBlockImp(p *peerState, piece int, block int, req
 			length = left
 		}
 	}
-	// log.Println("Requesting block", piece, ".", block, length, request)
+	if pickerLog.Enabled(LOG_DEBUG) {
+		t.logger(pickerLog).Debug("Requesting block", "peer", p.address, "piece", piece, "block", block,
+			"length", length, "request", request)
+	}
 	req[0] = opcode
 	uint32ToBytes(req[1:5], uint32(piece))
 	uint32ToBytes(req[5:9], uint32(begin))
@@ -584,13 +849,17 @@ func (t *TorrentSession) requestBlockImp(p *peerState, piece int, block int, req
 	return
 }
 
-func (t *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32) (err error) {
+func (t *TorrentSession) RecordBlock(p *peerState, piece, begin uint32, data []byte) (err error) {
 	block := begin / STANDARD_BLOCK_LENGTH
-	// log.Println("Received block", piece, ".", block)
+	p.log.Debug("Received block", "piece", piece, "block", block)
 	requestIndex := (uint64(piece) << 32) | uint64(begin)
+	if requested, ok := p.our_requests[requestIndex]; ok {
+		p.recordLatency(time.Now().Sub(requested))
+	}
 	delete(p.our_requests, requestIndex)
+	t.metrics.count(&t.metrics.blocksReceived, 1)
 	v, ok := t.activePieces[int(piece)]
-	if ok {
+	if ok && !v.writing {
 		requestCount := v.recordBlock(int(block))
 		if requestCount > 1 {
 			// Someone else has also requested this, so send cancel notices
@@ -603,43 +872,49 @@ func (t *TorrentSession) RecordBlock(p *peerState, piece, begin, length uint32)
 				}
 			}
 		}
-		t.si.Downloaded += int64(length)
+		t.si.Downloaded += int64(len(data))
+		if requestCount >= 0 {
+			v.sources[block] = p.address
+			t.cacheBlock(v, int(block), data)
+		}
 		if v.isComplete() {
-			delete(t.activePieces, int(piece))
-			ok, err = checkPiece(t.fileStore, t.totalSize, t.m, int(piece))
-			if !ok || err != nil {
-				log.Println("Ignoring bad piece", piece, err)
-				return
-			}
-			t.si.Left -= int64(v.pieceLength)
-			t.pieceSet.Set(int(piece))
-			t.goodPieces++
-			log.Println("Have", t.goodPieces, "of", t.totalPieces, "pieces.")
-			if t.goodPieces == t.totalPieces {
-				t.fetchTrackerInfo("completed")
-				// TODO: Drop connections to all seeders.
-			}
-			for _, p := range t.peers {
-				if p.have != nil {
-					if p.have.IsSet(int(piece)) {
-						// We don't do anything special. We rely on the caller
-						// to decide if this peer is still interesting.
-					} else {
-						// log.Println("...telling ", p)
-						haveMsg := make([]byte, 5)
-						haveMsg[0] = 4
-						uint32ToBytes(haveMsg[1:5], uint32(piece))
-						p.sendMessage(haveMsg)
-					}
-				}
-			}
+			t.writePiece(v)
 		}
 	} else {
-		log.Println("Received a block we already have.", piece, block, p.address)
+		p.log.Info("Received a block we already have", "piece", piece, "block", block)
 	}
 	return
 }
 
+// pieceCompleted is called once a piece has passed its hash check and is
+// on disk.
+func (t *TorrentSession) pieceCompleted(piece, pieceLength int) {
+	t.si.Left -= int64(pieceLength)
+	t.pieceSet.Set(piece)
+	t.goodPieces++
+	t.logger(storageLog).Info("Piece completed", "piece", piece, "good", t.goodPieces, "total", t.totalPieces)
+	if t.goodPieces == t.totalPieces {
+		// With files skipped we are done before this, but still have bytes
+		// left, so the tracker only hears about it now.
+		t.fetchTrackerInfo("completed")
+	}
+	if t.downloadComplete() {
+		t.moveCompleted()
+		t.enterSeedingMode()
+	}
+	for _, p := range t.peers {
+		if p.have != nil {
+			if p.have.IsSet(piece) {
+				// We don't do anything special. We rely on the caller
+				// to decide if this peer is still interesting.
+			} else {
+				p.log.Debug("Sending have", "piece", piece)
+				p.sendHave(piece)
+			}
+		}
+	}
+}
+
 func (t *TorrentSession) doChoke(p *peerState) (err error) {
 	p.peer_choking = true
 	err = t.removeRequests(p)
@@ -651,10 +926,14 @@ func (t *TorrentSession) removeRequests(p *peerState) (err error) {
 		piece := int(k >> 32)
 		begin := int(k)
 		block := begin / STANDARD_BLOCK_LENGTH
-		// log.Println("Forgetting we requested block ", piece, ".", block)
+		if pickerLog.Enabled(LOG_DEBUG) {
+			t.logger(pickerLog).Debug("Forgetting we requested block", "peer", p.address, "piece", piece,
+				"block", block)
+		}
 		t.removeRequest(piece, block)
 	}
-	p.our_requests = make(map[uint64]time.Time, MAX_OUR_REQUESTS)
+	p.our_requests = make(map[uint64]time.Time, p.maxRequests)
+	t.unpinPieces(p)
 	return
 }
 
@@ -671,7 +950,9 @@ func (t *TorrentSession) doCheckRequests(p *peerState) (err error) {
 		if now.Sub(v).Seconds() > 30 {
 			piece := int(k >> 32)
 			block := int(k) / STANDARD_BLOCK_LENGTH
-			// log.Println("timing out request of", piece, ".", block)
+			if pickerLog.Enabled(LOG_DEBUG) {
+				t.logger(pickerLog).Debug("Request timed out", "peer", p.address, "piece", piece, "block", block)
+			}
 			t.removeRequest(piece, block)
 		}
 	}
@@ -698,44 +979,46 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			return errors.New("this peer doesn't have the right info hash")
 		}
 		p.id = string(message[28:48])
+		if supportsExtensions(message[0:8]) {
+			p.sendExtensionHandshake()
+		}
 	} else {
 		if len(message) == 0 { // keep alive
 			return
 		}
 		messageId := message[0]
 		// Message 5 is optional, but must be sent as the first message.
-		if p.have == nil && messageId != 5 {
+		// Extension handshakes may come before it.
+		if p.have == nil && messageId != BITFIELD && messageId != EXTENDED {
 			// Fill out the have bitfield
 			p.have = NewBitset(t.totalPieces)
+			if t.superSeeding {
+				t.superSeedOffer(p)
+			}
 		}
 		switch id := message[0]; id {
 		case CHOKE:
-			// log.Println("choke", p.address)
+			p.log.Debug("Received choke")
 			if len(message) != 1 {
 				return errors.New("Unexpected length")
 			}
 			err = t.doChoke(p)
 		case UNCHOKE:
-			// log.Println("unchoke", p.address)
+			p.log.Debug("Received unchoke")
 			if len(message) != 1 {
 				return errors.New("Unexpected length")
 			}
 			p.peer_choking = false
-			for i := 0; i < MAX_OUR_REQUESTS; i++ {
-				err = t.RequestBlock(p)
-				if err != nil {
-					return
-				}
-			}
+			err = t.fillPipeline(p)
 		case INTERESTED:
-			// log.Println("interested", p)
+			p.log.Debug("Received interested")
 			if len(message) != 1 {
 				return errors.New("Unexpected length")
 			}
 			p.peer_interested = true
-			// TODO: Consider unchoking
+			t.peerInterested(p)
 		case NOT_INTERESTED:
-			// log.Println("not interested", p)
+			p.log.Debug("Received not interested")
 			if len(message) != 1 {
 				return errors.New("Unexpected length")
 			}
@@ -747,14 +1030,21 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			n := bytesToUint32(message[1:])
 			if n < uint32(p.have.n) {
 				p.have.Set(int(n))
-				if !p.am_interested && !t.pieceSet.IsSet(int(n)) {
+				if !p.am_interested && !t.pieceSet.IsSet(int(n)) && t.pieceWanted(int(n)) {
 					p.SetInterested(true)
 				}
 			} else {
 				return errors.New("have index is out of range.")
 			}
+			if t.superSeeding {
+				t.superSeedSawHave(p, int(n))
+			}
+			if t.seeding.complete && t.isSeed(p) {
+				// Neither of us needs the other.
+				return io.EOF
+			}
 		case BITFIELD:
-			// log.Println("bitfield", p.address)
+			p.log.Debug("Received bitfield")
 			if p.have != nil {
 				return errors.New("Late bitfield operation")
 			}
@@ -762,9 +1052,15 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if p.have == nil {
 				return errors.New("Invalid bitfield data.")
 			}
+			if t.seeding.complete && t.isSeed(p) {
+				return io.EOF
+			}
+			if t.superSeeding {
+				t.superSeedOffer(p)
+			}
 			t.checkInteresting(p)
 		case REQUEST:
-			// log.Println("request", p.address)
+			p.log.Debug("Received request")
 			if len(message) != 13 {
 				return errors.New("Unexpected message length")
 			}
@@ -777,6 +1073,10 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if !t.pieceSet.IsSet(int(index)) {
 				return errors.New("we don't have that piece.")
 			}
+			if !t.mayUpload(p, int(index)) {
+				// Not offered to this peer while super-seeding.
+				return
+			}
 			if int64(begin) >= t.m.Info.PieceLength {
 				return errors.New("begin out of range.")
 			}
@@ -786,9 +1086,7 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if length != STANDARD_BLOCK_LENGTH {
 				return errors.New("Unexpected block length.")
 			}
-			// TODO: Asynchronous
-			// p.AddRequest(index, begin, length)
-			return t.sendRequest(p, index, begin, length)
+			t.queueRequest(p, index, begin, length)
 		case PIECE:
 			// piece
 			if len(message) < 9 {
@@ -813,15 +1111,11 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 			if length > 128*1024 {
 				return errors.New("Block length too large.")
 			}
-			globalOffset := int64(index)*t.m.Info.PieceLength + int64(begin)
-			_, err = t.fileStore.WriteAt(message[9:], globalOffset)
-			if err != nil {
-				return err
-			}
-			t.RecordBlock(p, index, begin, uint32(length))
-			err = t.RequestBlock(p)
+			p.bytesReceived += int64(length)
+			t.RecordBlock(p, index, begin, message[9:])
+			err = t.fillPipeline(p)
 		case CANCEL:
-			// log.Println("cancel")
+			p.log.Debug("Received cancel")
 			if len(message) != 13 {
 				return errors.New("Unexpected message length")
 			}
@@ -852,6 +1146,8 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 				return errors.New(fmt.Sprintf("Unexpected length for port message:", len(message)))
 			}
 			go t.dht.AddNode(p.address)
+		case EXTENDED:
+			err = t.doExtendedMessage(p, message)
 		default:
 			return errors.New("Uknown message id")
 		}
@@ -859,33 +1155,71 @@ func (t *TorrentSession) DoMessage(p *peerState, message []byte) (err error) {
 	return
 }
 
-func (t *TorrentSession) sendRequest(peer *peerState, index, begin, length uint32) (err error) {
-	if !peer.am_choking {
-		// log.Println("Sending block", index, begin)
-		buf := make([]byte, length+9)
-		buf[0] = 7
-		uint32ToBytes(buf[1:5], index)
-		uint32ToBytes(buf[5:9], begin)
-		_, err = t.fileStore.ReadAt(buf[9:],
-			int64(index)*t.m.Info.PieceLength+int64(begin))
-		if err != nil {
-			return
-		}
-		peer.sendMessage(buf)
-		t.si.Uploaded += int64(length)
-	}
-	return
-}
-
 func (t *TorrentSession) checkInteresting(p *peerState) {
 	p.SetInterested(t.isInteresting(p))
 }
 
 func (t *TorrentSession) isInteresting(p *peerState) bool {
 	for i := 0; i < t.totalPieces; i++ {
-		if !t.pieceSet.IsSet(i) && p.have.IsSet(i) {
+		if !t.pieceSet.IsSet(i) && p.have.IsSet(i) && t.pieceWanted(i) {
 			return true
 		}
 	}
 	return false
 }
+
+// wantedPieces works out which pieces hold data of files we don't skip.
+// Returns nil if we want every piece.
+func wantedPieces(info *InfoDict, skip []bool, numPieces int) (wanted *Bitset) {
+	if skip == nil {
+		return nil
+	}
+	wanted = NewBitset(numPieces)
+	var offset int64
+	for i, f := range torrentFiles(info) {
+		if !skip[i] && f.Length > 0 {
+			first := int(offset / info.PieceLength)
+			last := int((offset + f.Length - 1) / info.PieceLength)
+			for j := first; j <= last; j++ {
+				wanted.Set(j)
+			}
+		}
+		offset += f.Length
+	}
+	return
+}
+
+func (t *TorrentSession) pieceWanted(piece int) bool {
+	return t.wantedPieces == nil || t.wantedPieces.IsSet(piece)
+}
+
+// downloadComplete is true once we have every piece we want.
+func (t *TorrentSession) downloadComplete() bool {
+	return t.haveAll(t.wantedPieces)
+}
+
+// filesComplete is true once the files we don't skip are all here. With
+// -seedOnly we want nothing more from the start, but that doesn't make the
+// files complete.
+func (t *TorrentSession) filesComplete() bool {
+	if !seedOnly {
+		return t.downloadComplete()
+	}
+	return t.haveAll(wantedPieces(&t.m.Info, t.storeSkip, t.totalPieces))
+}
+
+// haveAll is true if we have every piece in wanted. nil wants them all.
+func (t *TorrentSession) haveAll(wanted *Bitset) bool {
+	if t.goodPieces == t.totalPieces {
+		return true
+	}
+	if wanted == nil {
+		return false
+	}
+	for i := wanted.FindNextSet(0); i >= 0; i = wanted.FindNextSet(i + 1) {
+		if !t.pieceSet.IsSet(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,577 @@
+package main
+
+// A Transmission RPC endpoint at /transmission/rpc, so front-ends written
+// for Transmission can drive us. It covers the session-get, session-set,
+// session-stats, torrent-get, torrent-add, torrent-start, torrent-stop,
+// torrent-set and torrent-remove methods. Torrent ids are the session
+// manager's ids. Speeds are in kB/s of 1000 bytes, as Transmission has them.
+//
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TRANSMISSION_RPC_VERSION = 15
+
+// Transmission's torrent states.
+const (
+	TR_STATUS_STOPPED  = 0
+	TR_STATUS_DOWNLOAD = 4
+	TR_STATUS_SEED     = 6
+)
+
+type transmissionServer struct {
+	sessions  *sessionManager
+	token     string
+	sessionId string // Clients echo it in X-Transmission-Session-Id, against CSRF
+	started   time.Time
+
+	mu sync.Mutex
+	// Transmission keeps a speed limit even while it is switched off.
+	speedLimitUp, speedLimitDown               int // kB/s
+	speedLimitUpEnabled, speedLimitDownEnabled bool
+}
+
+func newTransmissionServer(sessions *sessionManager, token string) *transmissionServer {
+	id := make([]byte, 16)
+	rand.Read(id)
+	x := &transmissionServer{sessions: sessions, token: token, sessionId: fmt.Sprintf("%x", id),
+		started: time.Now()}
+	x.speedLimitUp = globalUploadLimit.Rate() / 1000
+	x.speedLimitUpEnabled = x.speedLimitUp > 0
+	x.speedLimitDown = globalDownloadLimit.Rate() / 1000
+	x.speedLimitDownEnabled = x.speedLimitDown > 0
+	return x
+}
+
+type transmissionRequest struct {
+	Method    string                 `json:"method"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Tag       interface{}            `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string                 `json:"result"`
+	Arguments map[string]interface{} `json:"arguments"`
+	Tag       interface{}            `json:"tag,omitempty"`
+}
+
+func (x *transmissionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !hasToken(r, x.token) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Taipei-Torrent"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Transmission-Session-Id") != x.sessionId {
+		w.Header().Set("X-Transmission-Session-Id", x.sessionId)
+		http.Error(w, "Missing or stale X-Transmission-Session-Id.", http.StatusConflict)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	var req transmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Arguments == nil {
+		req.Arguments = map[string]interface{}{}
+	}
+	args, err := x.call(req.Method, req.Arguments)
+	resp := transmissionResponse{Result: "success", Arguments: args, Tag: req.Tag}
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	if resp.Arguments == nil {
+		resp.Arguments = map[string]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (x *transmissionServer) call(method string, args map[string]interface{}) (map[string]interface{}, error) {
+	switch method {
+	case "session-get":
+		return x.sessionGet(), nil
+	case "session-set":
+		return nil, x.sessionSet(args)
+	case "session-stats":
+		return x.sessionStats(), nil
+	case "torrent-get":
+		return x.torrentGet(args), nil
+	case "torrent-add":
+		return x.torrentAdd(args)
+	case "torrent-start", "torrent-start-now":
+		return nil, x.forEach(args, (*TorrentSession).Resume)
+	case "torrent-stop":
+		return nil, x.forEach(args, (*TorrentSession).Pause)
+	case "torrent-set":
+		return nil, x.torrentSet(args)
+	case "torrent-remove":
+		return nil, x.torrentRemove(args)
+	}
+	return nil, errors.New("method name not recognized")
+}
+
+// Getters for loosely typed JSON arguments.
+
+func argNumber(args map[string]interface{}, key string) (n int, ok bool) {
+	f, ok := args[key].(float64)
+	return int(f), ok
+}
+
+func argBool(args map[string]interface{}, key string) (b, ok bool) {
+	b, ok = args[key].(bool)
+	return
+}
+
+func argString(args map[string]interface{}, key string) string {
+	s, _ := args[key].(string)
+	return s
+}
+
+func argNumbers(args map[string]interface{}, key string) (numbers []int) {
+	list, _ := args[key].([]interface{})
+	for _, v := range list {
+		if f, ok := v.(float64); ok {
+			numbers = append(numbers, int(f))
+		}
+	}
+	return
+}
+
+// selected returns the sessions the "ids" argument names: one id, a list of
+// ids and hash strings, or all of them if there is no list.
+func (x *transmissionServer) selected(args map[string]interface{}) (selected []*managedSession) {
+	all := x.sessions.List()
+	ids, ok := args["ids"]
+	if !ok || ids == "recently-active" {
+		return all
+	}
+	list, ok := ids.([]interface{})
+	if !ok {
+		list = []interface{}{ids}
+	}
+	for _, s := range all {
+		hash := fmt.Sprintf("%x", s.ts.m.InfoHash)
+		for _, id := range list {
+			if n, ok := id.(float64); ok && int(n) == s.id {
+				selected = append(selected, s)
+				break
+			}
+			if h, ok := id.(string); ok && strings.ToLower(h) == hash {
+				selected = append(selected, s)
+				break
+			}
+		}
+	}
+	return
+}
+
+func (x *transmissionServer) forEach(args map[string]interface{}, f func(*TorrentSession) error) (err error) {
+	for _, s := range x.selected(args) {
+		if err2 := f(s.ts); err2 != nil {
+			err = err2
+		}
+	}
+	return
+}
+
+func (x *transmissionServer) sessionGet() map[string]interface{} {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return map[string]interface{}{
+		"version":                    "2.94 (Taipei-Torrent)",
+		"rpc-version":                TRANSMISSION_RPC_VERSION,
+		"rpc-version-minimum":        1,
+		"session-id":                 x.sessionId,
+		"download-dir":               fileDir,
+		"peer-port":                  port,
+		"peer-limit-global":          maxGlobalPeers,
+		"peer-limit-per-torrent":     maxPeers,
+		"dht-enabled":                useDHT,
+		"pex-enabled":                false,
+		"encryption":                 "tolerated",
+		"speed-limit-up":             x.speedLimitUp,
+		"speed-limit-up-enabled":     x.speedLimitUpEnabled,
+		"speed-limit-down":           x.speedLimitDown,
+		"speed-limit-down-enabled":   x.speedLimitDownEnabled,
+		"seedRatioLimit":             seedRatio,
+		"seedRatioLimited":           seedRatio > 0,
+		"idle-seeding-limit":         int(seedIdleTime.Minutes()),
+		"idle-seeding-limit-enabled": seedIdleTime > 0,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  1000,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}
+}
+
+// sessionSet only changes the global speed limits.
+func (x *transmissionServer) sessionSet(args map[string]interface{}) (err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if n, ok := argNumber(args, "speed-limit-up"); ok {
+		x.speedLimitUp = n
+	}
+	if b, ok := argBool(args, "speed-limit-up-enabled"); ok {
+		x.speedLimitUpEnabled = b
+	}
+	if n, ok := argNumber(args, "speed-limit-down"); ok {
+		x.speedLimitDown = n
+	}
+	if b, ok := argBool(args, "speed-limit-down-enabled"); ok {
+		x.speedLimitDownEnabled = b
+	}
+	if x.speedLimitUp < 0 || x.speedLimitDown < 0 {
+		return errors.New("Limits can't be negative.")
+	}
+	up, down := 0, 0
+	if x.speedLimitUpEnabled {
+		up = x.speedLimitUp * 1000
+	}
+	if x.speedLimitDownEnabled {
+		down = x.speedLimitDown * 1000
+	}
+	SetGlobalRateLimits(up, down)
+	return
+}
+
+func (x *transmissionServer) sessionStats() map[string]interface{} {
+	var active, paused int
+	var down, up float64
+	var downloaded, uploaded int64
+	sessions := x.sessions.List()
+	for _, s := range sessions {
+		st := s.status()
+		if st.State == "downloading" || st.State == "seeding" {
+			active++
+		} else {
+			paused++
+		}
+		down += st.DownloadRate
+		up += st.UploadRate
+		downloaded += st.Downloaded
+		uploaded += st.Uploaded
+	}
+	// We don't keep statistics across runs, so both are for this run.
+	stats := map[string]interface{}{
+		"uploadedBytes":   uploaded,
+		"downloadedBytes": downloaded,
+		"filesAdded":      len(sessions),
+		"sessionCount":    1,
+		"secondsActive":   int(time.Now().Sub(x.started).Seconds()),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(sessions),
+		"downloadSpeed":      int(down),
+		"uploadSpeed":        int(up),
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}
+}
+
+func (x *transmissionServer) torrentGet(args map[string]interface{}) map[string]interface{} {
+	var fields []string
+	list, _ := args["fields"].([]interface{})
+	for _, f := range list {
+		if s, ok := f.(string); ok {
+			fields = append(fields, s)
+		}
+	}
+	torrents := []map[string]interface{}{}
+	for _, s := range x.selected(args) {
+		all := transmissionTorrent(s)
+		if len(fields) == 0 {
+			torrents = append(torrents, all)
+			continue
+		}
+		t := make(map[string]interface{})
+		for _, f := range fields {
+			if v, ok := all[f]; ok {
+				t[f] = v
+			}
+		}
+		torrents = append(torrents, t)
+	}
+	return map[string]interface{}{"torrents": torrents}
+}
+
+// transmissionTorrent describes a session with torrent-get's fields.
+func transmissionTorrent(s *managedSession) (t map[string]interface{}) {
+	ts := s.ts
+	s.inspect(func() {
+		st := ts.status()
+		status := TR_STATUS_DOWNLOAD
+		switch st.State {
+		case "seeding":
+			status = TR_STATUS_SEED
+		case "paused", "stopped":
+			status = TR_STATUS_STOPPED
+		}
+
+		var sizeWhenDone, leftUntilDone int64
+		for i := 0; i < ts.totalPieces; i++ {
+			if ts.pieceWanted(i) {
+				sizeWhenDone += ts.pieceBytes(i)
+				if !ts.pieceSet.IsSet(i) {
+					leftUntilDone += ts.pieceBytes(i)
+				}
+			}
+		}
+		percentDone := 1.0
+		if sizeWhenDone > 0 {
+			percentDone = float64(sizeWhenDone-leftUntilDone) / float64(sizeWhenDone)
+		}
+		eta := -1
+		if st.DownloadRate > 0 {
+			eta = int(float64(leftUntilDone) / st.DownloadRate)
+		}
+
+		files := []map[string]interface{}{}
+		fileStats := []map[string]interface{}{}
+		wanted := []int{}
+		priorities := []int{}
+		for _, f := range ts.fileStatus() {
+			done := ts.fileBytesCompleted(f.Index)
+			w := 0
+			if f.Priority != PRIORITY_SKIP {
+				w = 1
+			}
+			files = append(files, map[string]interface{}{"name": f.Path, "length": f.Length,
+				"bytesCompleted": done})
+			fileStats = append(fileStats, map[string]interface{}{"bytesCompleted": done,
+				"wanted": w == 1, "priority": 0})
+			wanted = append(wanted, w)
+			priorities = append(priorities, 0)
+		}
+
+		peers := []map[string]interface{}{}
+		sendingToUs, gettingFromUs := 0, 0
+		for _, p := range ts.peers {
+			host, portString, _ := net.SplitHostPort(p.address)
+			peerPort, _ := strconv.Atoi(portString)
+			progress := 0.0
+			if p.have != nil && ts.totalPieces > 0 {
+				progress = float64(p.have.Count()) / float64(ts.totalPieces)
+			}
+			if p.downloadRate > 0 {
+				sendingToUs++
+			}
+			if len(p.peer_requests) > 0 {
+				gettingFromUs++
+			}
+			peers = append(peers, map[string]interface{}{"address": host, "port": peerPort,
+				"clientName": clientName(p.id), "rateToClient": int(p.downloadRate), "rateToPeer": int(p.uploadRate),
+				"clientIsChoked": p.peer_choking, "clientIsInterested": p.am_interested,
+				"peerIsChoked": p.am_choking, "peerIsInterested": p.peer_interested,
+				"progress": progress})
+		}
+
+		tracker := ts.trackerStatus()
+		announceResult := "Success"
+		if tracker.LastError != "" {
+			announceResult = tracker.LastError
+		}
+		var lastAnnounce int64
+		if !tracker.LastAnnounce.IsZero() {
+			lastAnnounce = tracker.LastAnnounce.Unix()
+		}
+		trackers := []map[string]interface{}{}
+		trackerStats := []map[string]interface{}{}
+		if tracker.Announce != "" {
+			trackers = append(trackers, map[string]interface{}{"id": 0, "tier": 0, "announce": tracker.Announce})
+			trackerStats = append(trackerStats, map[string]interface{}{"id": 0, "tier": 0,
+				"announce": tracker.Announce, "lastAnnounceTime": lastAnnounce,
+				"lastAnnounceResult": announceResult, "lastAnnounceSucceeded": tracker.LastError == "",
+				"hasAnnounced": lastAnnounce != 0, "seederCount": tracker.Seeders,
+				"leecherCount": tracker.Leechers})
+		}
+
+		errorCode, errorString := 0, ""
+		if st.Error != "" {
+			// Transmission's "local error".
+			errorCode, errorString = 3, st.Error
+		}
+		t = map[string]interface{}{
+			"id":                      s.id,
+			"hashString":              st.InfoHash,
+			"name":                    st.Name,
+			"status":                  status,
+			"error":                   errorCode,
+			"errorString":             errorString,
+			"addedDate":               s.added.Unix(),
+			"startDate":               s.added.Unix(),
+			"downloadDir":             fileDir,
+			"comment":                 ts.m.Comment,
+			"creator":                 ts.m.CreatedBy,
+			"isPrivate":               ts.m.Info.Private == 1,
+			"isFinished":              st.State == "stopped",
+			"isStalled":               false,
+			"queuePosition":           s.id,
+			"totalSize":               st.Size,
+			"sizeWhenDone":            sizeWhenDone,
+			"leftUntilDone":           leftUntilDone,
+			"haveValid":               st.Size - ts.bytesLeft(),
+			"haveUnchecked":           0,
+			"desiredAvailable":        0,
+			"percentDone":             percentDone,
+			"metadataPercentComplete": 1,
+			"recheckProgress":         0,
+			"eta":                     eta,
+			"downloadedEver":          st.Downloaded,
+			"uploadedEver":            st.Uploaded,
+			"uploadRatio":             st.Ratio,
+			"rateDownload":            int(st.DownloadRate),
+			"rateUpload":              int(st.UploadRate),
+			"peersConnected":          st.Peers,
+			"peersSendingToUs":        sendingToUs,
+			"peersGettingFromUs":      gettingFromUs,
+			"peers":                   peers,
+			"pieceCount":              st.Pieces,
+			"pieceSize":               ts.m.Info.PieceLength,
+			"pieces":                  base64.StdEncoding.EncodeToString(ts.pieceSet.Bytes()),
+			"files":                   files,
+			"fileStats":               fileStats,
+			"wanted":                  wanted,
+			"priorities":              priorities,
+			"trackers":                trackers,
+			"trackerStats":            trackerStats,
+			"webseeds":                []string{},
+			"uploadLimit":             st.UploadLimit / 1000,
+			"uploadLimited":           st.UploadLimit > 0,
+			"downloadLimit":           st.DownloadLimit / 1000,
+			"downloadLimited":         st.DownloadLimit > 0,
+			"seedRatioLimit":          ts.SeedingGoals().Ratio,
+			"seedRatioMode":           0,
+		}
+	})
+	return
+}
+
+// fileBytesCompleted is how much of file i is in pieces we have.
+func (t *TorrentSession) fileBytesCompleted(i int) (done int64) {
+	var start int64
+	files := torrentFiles(&t.m.Info)
+	for j := 0; j < i; j++ {
+		start += files[j].Length
+	}
+	end := start + files[i].Length
+	pieceLength := t.m.Info.PieceLength
+	for p := int(start / pieceLength); int64(p)*pieceLength < end && p < t.totalPieces; p++ {
+		if !t.pieceSet.IsSet(p) {
+			continue
+		}
+		from, to := int64(p)*pieceLength, int64(p)*pieceLength+t.pieceBytes(p)
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		done += to - from
+	}
+	return
+}
+
+func (x *transmissionServer) torrentAdd(args map[string]interface{}) (reply map[string]interface{}, err error) {
+	if dir := argString(args, "download-dir"); dir != "" && dir != fileDir {
+		return nil, errors.New("download-dir can't differ from " + fileDir)
+	}
+	torrent := argString(args, "filename")
+	if metainfo := argString(args, "metainfo"); metainfo != "" {
+		var data []byte
+		if data, err = base64.StdEncoding.DecodeString(metainfo); err != nil {
+			return
+		}
+		var f *os.File
+		if f, err = ioutil.TempFile("", "taipei-torrent"); err != nil {
+			return
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(data)
+		f.Close()
+		if err != nil {
+			return
+		}
+		torrent = f.Name()
+	}
+	if torrent == "" {
+		return nil, errors.New("no filename or metainfo given")
+	}
+	ts, err := x.sessions.Add(torrent)
+	key := "torrent-added"
+	if err == errDuplicateTorrent {
+		key, err = "torrent-duplicate", nil
+	} else if err != nil {
+		return
+	}
+	s := x.sessions.Get(fmt.Sprintf("%x", ts.m.InfoHash))
+	if s == nil {
+		return nil, errors.New("Removed while being added.")
+	}
+	if paused, _ := argBool(args, "paused"); paused && key == "torrent-added" {
+		ts.Pause()
+	}
+	name, _ := torrentName(&ts.m.Info)
+	return map[string]interface{}{key: map[string]interface{}{"id": s.id, "name": name,
+		"hashString": fmt.Sprintf("%x", ts.m.InfoHash)}}, nil
+}
+
+func (x *transmissionServer) torrentSet(args map[string]interface{}) (err error) {
+	for _, s := range x.selected(args) {
+		ts := s.ts
+		setLimit := func(b *tokenBucket, limit, limited string) {
+			if on, ok := argBool(args, limited); ok && !on {
+				b.SetRate(0)
+			} else if n, ok := argNumber(args, limit); ok && n >= 0 {
+				b.SetRate(n * 1000)
+			}
+		}
+		setLimit(ts.uploadLimit, "uploadLimit", "uploadLimited")
+		setLimit(ts.downloadLimit, "downloadLimit", "downloadLimited")
+		for _, i := range argNumbers(args, "files-wanted") {
+			if err2 := ts.SetFilePriority(i, PRIORITY_NORMAL); err2 != nil {
+				err = err2
+			}
+		}
+		for _, i := range argNumbers(args, "files-unwanted") {
+			if err2 := ts.SetFilePriority(i, PRIORITY_SKIP); err2 != nil {
+				err = err2
+			}
+		}
+	}
+	return
+}
+
+func (x *transmissionServer) torrentRemove(args map[string]interface{}) (err error) {
+	if del, _ := argBool(args, "delete-local-data"); del {
+		return errors.New("delete-local-data is not supported")
+	}
+	for _, s := range x.selected(args) {
+		if err2 := x.sessions.Remove(fmt.Sprintf("%x", s.ts.m.InfoHash)); err2 != nil {
+			err = err2
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransmissionRPC(t *testing.T) {
+	oldTrackerLessMode := trackerLessMode
+	trackerLessMode = true
+	defer func() { trackerLessMode = oldTrackerLessMode }()
+
+	sessions := newSessionManager(nil)
+	sessions.run = serveControl
+	ts := newControlledSession()
+	ts.pieceSet.Set(0)
+	ts.goodPieces = 1
+	if _, err := sessions.start(ts); err != nil {
+		t.Fatal(err)
+	}
+	x := newTransmissionServer(sessions, "secret")
+	server := httptest.NewServer(x)
+	defer server.Close()
+
+	sessionId := ""
+	call := func(method, args string) (resp transmissionResponse) {
+		body := `{"method": "` + method + `", "arguments": ` + args + `, "tag": 7}`
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString(body))
+		req.SetBasicAuth("admin", "secret")
+		req.Header.Set("X-Transmission-Session-Id", sessionId)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if r.StatusCode == http.StatusConflict {
+			resp.Result = "conflict"
+			sessionId = r.Header.Get("X-Transmission-Session-Id")
+			return
+		}
+		if err = json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if tag, _ := resp.Tag.(float64); tag != 7 {
+			t.Errorf("Tag %v, wanted 7", resp.Tag)
+		}
+		return
+	}
+
+	if resp := call("session-get", "{}"); resp.Result != "conflict" || sessionId == "" {
+		t.Fatalf("No session id handshake: %+v", resp)
+	}
+	if resp := call("session-get", "{}"); resp.Result != "success" || resp.Arguments["rpc-version"] == nil {
+		t.Errorf("session-get: %+v", resp)
+	}
+	if resp := call("no-such-method", "{}"); resp.Result == "success" {
+		t.Errorf("Unknown method succeeded")
+	}
+
+	get := func() map[string]interface{} {
+		resp := call("torrent-get", `{"ids": [1], "fields": ["id", "status", "haveValid", "percentDone", "wanted", "pieces"]}`)
+		torrents, _ := resp.Arguments["torrents"].([]interface{})
+		if len(torrents) != 1 {
+			t.Fatalf("torrent-get: %+v", resp)
+		}
+		return torrents[0].(map[string]interface{})
+	}
+	tor := get()
+	if len(tor) != 6 || tor["id"] != 1.0 || tor["status"] != float64(TR_STATUS_DOWNLOAD) || tor["haveValid"] != 16.0 ||
+		tor["pieces"] != "gA==" {
+		t.Errorf("torrent-get gave %v", tor)
+	}
+
+	call("torrent-stop", `{"ids": 1}`)
+	if tor = get(); tor["status"] != float64(TR_STATUS_STOPPED) {
+		t.Errorf("Status %v after torrent-stop", tor["status"])
+	}
+	call("torrent-start", `{"ids": ["3031323334353637383930313233343536373839"]}`)
+	if tor = get(); tor["status"] != float64(TR_STATUS_DOWNLOAD) {
+		t.Errorf("Status %v after torrent-start", tor["status"])
+	}
+
+	call("torrent-set", `{"ids": [1], "files-unwanted": [0], "uploadLimit": 5, "uploadLimited": true}`)
+	if tor = get(); tor["wanted"].([]interface{})[0] != 0.0 || tor["status"] != float64(TR_STATUS_SEED) {
+		t.Errorf("torrent-set gave %v", tor)
+	}
+	if ts.uploadLimit.Rate() != 5000 {
+		t.Errorf("Upload limit %d", ts.uploadLimit.Rate())
+	}
+
+	defer SetGlobalRateLimits(globalUploadLimit.Rate(), globalDownloadLimit.Rate())
+	call("session-set", `{"speed-limit-down": 100, "speed-limit-down-enabled": true}`)
+	if globalDownloadLimit.Rate() != 100000 {
+		t.Errorf("Global download limit %d", globalDownloadLimit.Rate())
+	}
+
+	if resp := call("torrent-remove", `{"ids": [1]}`); resp.Result != "success" || sessions.Get(
+		"3031323334353637383930313233343536373839") != nil {
+		t.Errorf("torrent-remove: %+v", resp)
+	}
+	sessions.Wait()
+}
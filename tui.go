@@ -0,0 +1,407 @@
+package main
+
+// A full screen status display for terminals, with -tui. It shows one
+// session at a time: progress, rates, a piece availability strip and the
+// peers, with the latest log lines below. Without a terminal we keep
+// printing log lines.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var useTUI bool
+
+func init() {
+	flag.BoolVar(&useTUI, "tui", false, "Show a full screen status display instead of log lines, if the output "+
+		"is a terminal. Keys: p pauses or resumes, [ and ] pick a torrent, d/D and u/U lower and raise the "+
+		"download and upload limits, q quits.")
+}
+
+// How many log lines the display keeps.
+const TUI_LOG_LINES = 6
+
+// The rate limits d/D and u/U step through, in bytes per second. Above
+// the last is unlimited.
+var tuiRateSteps = []int{10e3, 25e3, 50e3, 100e3, 250e3, 500e3, 1e6, 2e6, 5e6, 10e6}
+
+// Non-zero while the display is up. Sessions don't log their status each
+// second then.
+var tuiActive int32
+
+func statusDisplayed() bool {
+	return atomic.LoadInt32(&tuiActive) != 0
+}
+
+type tui struct {
+	sessions *sessionManager
+	quit     func()
+	done     chan bool
+	renderMu sync.Mutex // One render at a time
+
+	mu       sync.Mutex
+	logLines []string
+	selected int
+	message  string
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func stty(args ...string) (out string, err error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	b, err := cmd.Output()
+	return strings.TrimSpace(string(b)), err
+}
+
+// startTUI takes over the terminal. quit is called when the user presses q.
+// stop gives the terminal back.
+func startTUI(sessions *sessionManager, quit func()) (stop func(), err error) {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return nil, errors.New("Not a terminal.")
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return
+	}
+	if _, err = stty("cbreak", "-echo"); err != nil {
+		return
+	}
+	u := &tui{sessions: sessions, quit: quit, done: make(chan bool)}
+	log.SetOutput(u)
+	atomic.StoreInt32(&tuiActive, 1)
+	// Switch to the alternate screen, and hide the cursor.
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	go u.readKeys()
+	go u.run()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			close(u.done)
+			atomic.StoreInt32(&tuiActive, 0)
+			os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+			stty(saved)
+			log.SetOutput(os.Stderr)
+			// What was logged last is often why we stopped.
+			for _, l := range u.logLines {
+				os.Stderr.WriteString(l + "\n")
+			}
+		})
+	}
+	return
+}
+
+// Write keeps the log output, for the display.
+func (u *tui) Write(p []byte) (n int, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		u.logLines = append(u.logLines, l)
+	}
+	if len(u.logLines) > TUI_LOG_LINES {
+		u.logLines = u.logLines[len(u.logLines)-TUI_LOG_LINES:]
+	}
+	return len(p), nil
+}
+
+func (u *tui) run() {
+	tick := time.NewTicker(1 * time.Second)
+	defer tick.Stop()
+	for {
+		u.render()
+		select {
+		case <-tick.C:
+		case <-u.done:
+			return
+		}
+	}
+}
+
+func (u *tui) readKeys() {
+	b := make([]byte, 1)
+	for {
+		if n, err := os.Stdin.Read(b); err != nil {
+			return
+		} else if n == 1 {
+			u.key(b[0])
+			u.render()
+		}
+	}
+}
+
+func (u *tui) key(k byte) {
+	list := u.sessions.List()
+	u.mu.Lock()
+	selected := u.selected
+	u.mu.Unlock()
+	var message string
+	switch k {
+	case 'q':
+		message = "Stopping."
+		go u.quit()
+	case '[', ']':
+		if len(list) > 0 {
+			if k == '[' {
+				selected += len(list) - 1
+			} else {
+				selected++
+			}
+			selected %= len(list)
+		}
+	case 'p':
+		if selected < len(list) {
+			s := list[selected]
+			var err error
+			if s.status().State == "paused" {
+				message, err = "Resumed.", s.ts.Resume()
+			} else {
+				message, err = "Paused.", s.ts.Pause()
+			}
+			if err != nil {
+				message = err.Error()
+			}
+		}
+	case 'd', 'D':
+		rate := stepRate(globalDownloadLimit.Rate(), k == 'D')
+		SetGlobalRateLimits(globalUploadLimit.Rate(), rate)
+		message = "Download limit " + formatRate(rate)
+	case 'u', 'U':
+		rate := stepRate(globalUploadLimit.Rate(), k == 'U')
+		SetGlobalRateLimits(rate, globalDownloadLimit.Rate())
+		message = "Upload limit " + formatRate(rate)
+	default:
+		return
+	}
+	u.mu.Lock()
+	u.selected, u.message = selected, message
+	u.mu.Unlock()
+}
+
+// stepRate moves a rate limit to the next of tuiRateSteps up or down. 0
+// is unlimited.
+func stepRate(rate int, up bool) int {
+	if up {
+		for _, step := range tuiRateSteps {
+			if rate != 0 && step > rate {
+				return step
+			}
+		}
+		return 0
+	}
+	for i := len(tuiRateSteps) - 1; i >= 0; i-- {
+		if rate == 0 || tuiRateSteps[i] < rate {
+			return tuiRateSteps[i]
+		}
+	}
+	return tuiRateSteps[0]
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1000 && i < len(units)-1; i++ {
+		n /= 1000
+	}
+	if i == 0 {
+		return strconv.Itoa(int(n)) + " B"
+	}
+	return strconv.FormatFloat(n, 'f', 1, 64) + " " + units[i]
+}
+
+func formatRate(rate int) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return formatBytes(float64(rate)) + "/s"
+}
+
+func formatETA(seconds int) string {
+	if seconds < 0 {
+		return "unknown"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// terminalSize returns the rows and columns of the terminal.
+func terminalSize() (rows, cols int) {
+	rows, cols = 24, 80
+	out, err := stty("size")
+	if err != nil {
+		return
+	}
+	if f := strings.Fields(out); len(f) == 2 {
+		r, err1 := strconv.Atoi(f[0])
+		c, err2 := strconv.Atoi(f[1])
+		if err1 == nil && err2 == nil && r > 0 && c > 0 {
+			rows, cols = r, c
+		}
+	}
+	return
+}
+
+// availabilityStrip draws the pieces in width characters: # for pieces we
+// have, otherwise how many peers have the rarest piece we lack, . for none
+// and + for ten or more. Runs on the main goroutine.
+func (t *TorrentSession) availabilityStrip(width int) string {
+	if t.totalPieces == 0 || width <= 0 {
+		return ""
+	}
+	if width > t.totalPieces {
+		width = t.totalPieces
+	}
+	counts := t.pieceAvailability()
+	strip := make([]byte, width)
+	for c := range strip {
+		lo, hi := c*t.totalPieces/width, (c+1)*t.totalPieces/width
+		rarest := -1
+		for i := lo; i < hi; i++ {
+			if !t.pieceSet.IsSet(i) && (rarest < 0 || counts[i] < rarest) {
+				rarest = counts[i]
+			}
+		}
+		switch {
+		case rarest < 0:
+			strip[c] = '#'
+		case rarest == 0:
+			strip[c] = '.'
+		case rarest < 10:
+			strip[c] = byte('0' + rarest)
+		default:
+			strip[c] = '+'
+		}
+	}
+	return string(strip)
+}
+
+// peerFlags are like µTorrent's: D we download, d we want to but are
+// choked, U we upload, u the peer wants to but we choke it.
+func peerFlags(p PeerStatus) (flags string) {
+	if p.Interested {
+		if p.PeerChoking {
+			flags += "d"
+		} else {
+			flags += "D"
+		}
+	}
+	if p.PeerInterested {
+		if p.Choking {
+			flags += "u"
+		} else {
+			flags += "U"
+		}
+	}
+	return
+}
+
+type byDownloadRate []PeerStatus
+
+func (a byDownloadRate) Len() int           { return len(a) }
+func (a byDownloadRate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDownloadRate) Less(i, j int) bool { return a[i].DownloadRate > a[j].DownloadRate }
+
+func (u *tui) render() {
+	u.renderMu.Lock()
+	defer u.renderMu.Unlock()
+	rows, cols := terminalSize()
+	list := u.sessions.List()
+	var b bytes.Buffer
+	used := 0
+	line := func(format string, args ...interface{}) {
+		s := []rune(fmt.Sprintf(format, args...))
+		if len(s) > cols {
+			s = s[:cols]
+		}
+		b.WriteString(string(s) + "\x1b[K\r\n")
+		used++
+	}
+
+	u.mu.Lock()
+	if u.selected >= len(list) {
+		u.selected = 0
+	}
+	selected := u.selected
+	u.mu.Unlock()
+	if len(list) == 0 {
+		line("No torrents.")
+	} else {
+		s := list[selected]
+		var st SessionStatus
+		var peers []PeerStatus
+		var strip string
+		s.inspect(func() {
+			st = s.ts.status()
+			peers = s.ts.peerStatus()
+			strip = s.ts.availabilityStrip(cols - 2)
+		})
+		line("%s (%d of %d) %s", st.Name, selected+1, len(list), st.State)
+		done := 1.0
+		if st.Pieces > 0 {
+			done = float64(st.GoodPieces) / float64(st.Pieces)
+		}
+		barWidth := cols - 10
+		if barWidth < 10 {
+			barWidth = 10
+		}
+		filled := int(done * float64(barWidth))
+		line("[%s%s] %5.1f%%", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), 100*done)
+		line("Down %s/s  Up %s/s  ETA %s  Ratio %.2f  Peers %d", formatBytes(st.DownloadRate),
+			formatBytes(st.UploadRate), formatETA(st.ETA), st.Ratio, st.Peers)
+		line("Global limits: down %s, up %s", formatRate(globalDownloadLimit.Rate()),
+			formatRate(globalUploadLimit.Rate()))
+		line("")
+		line("[%s]", strip)
+		line("# have, 1-9 peers with the piece, + more, . nobody")
+		line("")
+		line("%-24s %-24s %5s %12s %s", "Address", "Client", "Has", "Down", "Flags")
+		sort.Sort(byDownloadRate(peers))
+		room := rows - used - TUI_LOG_LINES - 3
+		for i, p := range peers {
+			if i >= room {
+				line("... and %d more", len(peers)-i)
+				break
+			}
+			has := 0
+			if st.Pieces > 0 {
+				has = 100 * p.Pieces / st.Pieces
+			}
+			line("%-24s %-24s %4d%% %10s/s %s", p.Address, p.Client, has, formatBytes(p.DownloadRate), peerFlags(p))
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.done:
+		return
+	default:
+	}
+	for used < rows-TUI_LOG_LINES-2 {
+		line("")
+	}
+	for i := 0; i < TUI_LOG_LINES; i++ {
+		if i < len(u.logLines) {
+			line("%s", u.logLines[i])
+		} else {
+			line("")
+		}
+	}
+	line("%s", u.message)
+	b.WriteString("p pause/resume  [ ] torrent  d/D u/U limits  q quit\x1b[K")
+	os.Stdout.WriteString("\x1b[H" + b.String())
+}
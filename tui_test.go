@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStepRate(t *testing.T) {
+	tests := []struct {
+		rate        int
+		up          bool
+		steppedRate int
+	}{
+		{0, true, 0},
+		{0, false, 10e6},
+		{10e6, true, 0},
+		{100e3, true, 250e3},
+		{100e3, false, 50e3},
+		{120e3, true, 250e3},
+		{120e3, false, 100e3},
+		{10e3, false, 10e3},
+		{5e3, true, 10e3},
+	}
+	for _, test := range tests {
+		if r := stepRate(test.rate, test.up); r != test.steppedRate {
+			t.Errorf("stepRate(%d, %v) = %d, wanted %d", test.rate, test.up, r, test.steppedRate)
+		}
+	}
+}
+
+func TestAvailabilityStrip(t *testing.T) {
+	ts := &TorrentSession{peers: make(map[string]*peerState), totalPieces: 8, pieceSet: NewBitset(8)}
+	ts.pieceSet.Set(0)
+	ts.pieceSet.Set(1)
+	a, b := &peerState{have: NewBitset(8)}, &peerState{have: NewBitset(8)}
+	a.have.Set(2)
+	a.have.Set(3)
+	b.have.Set(3)
+	ts.peers["a:1"], ts.peers["b:1"] = a, b
+	if s := ts.availabilityStrip(80); s != "##12...." {
+		t.Errorf("Strip %q", s)
+	}
+	if s := ts.availabilityStrip(4); s != "#1.." {
+		t.Errorf("Strip %q", s)
+	}
+}
+
+func TestPeerFlags(t *testing.T) {
+	if f := peerFlags(PeerStatus{Interested: true, PeerInterested: true, Choking: true}); f != "Du" {
+		t.Errorf("Flags %q", f)
+	}
+	if f := peerFlags(PeerStatus{Interested: true, PeerChoking: true}); f != "d" {
+		t.Errorf("Flags %q", f)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// Announces to UDP trackers (BEP 15). The datagrams go through
+// proxyListenPacket, so a SOCKS5 proxy carries them in a UDP associate and
+// resolves the tracker's name itself.
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	UDP_TRACKER_PROTOCOL_ID = 0x41727101980
+	UDP_TRACKER_TIMEOUT     = 15 * time.Second
+	UDP_TRACKER_ATTEMPTS    = 2
+)
+
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+)
+
+var udpTrackerEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+// getUDPTrackerInfo announces with the parameters announceURL put in the
+// query of a udp:// URL.
+func getUDPTrackerInfo(announce string) (tr *TrackerResponse, err error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return
+	}
+	q := u.Query()
+	infoHash, peerId := q.Get("info_hash"), q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerId) != 20 {
+		return nil, errors.New("Bad info_hash or peer_id for UDP tracker " + u.Host)
+	}
+	event, ok := udpTrackerEvents[q.Get("event")]
+	if !ok {
+		return nil, errors.New("Unknown event " + q.Get("event"))
+	}
+	// proxyListenPacket refuses first under -proxyStrict, so we don't look
+	// up a name the proxy should have.
+	pc, err := proxyListenPacket()
+	if err != nil {
+		return
+	}
+	defer pc.Close()
+	var addr net.Addr = proxyAddr(u.Host)
+	if !useProxy() || proxy.scheme != "socks5" {
+		if addr, err = net.ResolveUDPAddr("udp", u.Host); err != nil {
+			return
+		}
+	}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:], UDP_TRACKER_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(req[8:], udpActionConnect)
+	resp, err := udpTrackerRequest(pc, addr, req, 16)
+	if err != nil || udpTrackerFailure(resp, &tr) {
+		return
+	}
+	connectionId := binary.BigEndian.Uint64(resp[8:])
+
+	numWant := int64(-1)
+	if s := q.Get("numwant"); s != "" {
+		numWant, _ = strconv.ParseInt(s, 10, 32)
+	}
+	port, _ := strconv.ParseUint(q.Get("port"), 10, 16)
+	req = make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:], connectionId)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	copy(req[16:], infoHash)
+	copy(req[36:], peerId)
+	binary.BigEndian.PutUint64(req[56:], uint64(queryInt(q, "downloaded")))
+	binary.BigEndian.PutUint64(req[64:], uint64(queryInt(q, "left")))
+	binary.BigEndian.PutUint64(req[72:], uint64(queryInt(q, "uploaded")))
+	binary.BigEndian.PutUint32(req[80:], event)
+	binary.BigEndian.PutUint32(req[88:], rand.Uint32())
+	binary.BigEndian.PutUint32(req[92:], uint32(numWant))
+	binary.BigEndian.PutUint16(req[96:], uint16(port))
+	if resp, err = udpTrackerRequest(pc, addr, req, 20); err != nil || udpTrackerFailure(resp, &tr) {
+		return
+	}
+	peers := resp[20:]
+	tr = &TrackerResponse{
+		Interval:   time.Duration(binary.BigEndian.Uint32(resp[8:])),
+		Incomplete: int(binary.BigEndian.Uint32(resp[12:])),
+		Complete:   int(binary.BigEndian.Uint32(resp[16:])),
+		Peers:      string(peers[:len(peers)-len(peers)%6]),
+	}
+	return
+}
+
+// udpTrackerFailure turns an error reply into a failure reason, the way an
+// HTTP tracker reports one.
+func udpTrackerFailure(resp []byte, tr **TrackerResponse) bool {
+	if binary.BigEndian.Uint32(resp[0:]) != udpActionError {
+		return false
+	}
+	*tr = &TrackerResponse{FailureReason: string(resp[8:])}
+	return true
+}
+
+func queryInt(q url.Values, key string) int64 {
+	n, _ := strconv.ParseInt(q.Get(key), 10, 64)
+	return n
+}
+
+// udpTrackerRequest fills in a transaction id, sends req and waits for the
+// matching reply of at least minLen bytes, sending again if it is lost. An
+// error reply is returned as is; see udpTrackerFailure.
+func udpTrackerRequest(pc net.PacketConn, addr net.Addr, req []byte, minLen int) (resp []byte, err error) {
+	transaction := rand.Uint32()
+	binary.BigEndian.PutUint32(req[12:], transaction)
+	action := binary.BigEndian.Uint32(req[8:])
+	buf := make([]byte, 2048)
+	for i := 0; i < UDP_TRACKER_ATTEMPTS; i++ {
+		if _, err = pc.WriteTo(req, addr); err != nil {
+			return
+		}
+		pc.SetReadDeadline(time.Now().Add(UDP_TRACKER_TIMEOUT))
+		for {
+			var n int
+			if n, _, err = pc.ReadFrom(buf); err != nil {
+				break
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transaction {
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[0:]) {
+			case action:
+				if n < minLen {
+					return nil, errors.New("Short reply from UDP tracker " + addr.String())
+				}
+				return buf[:n], nil
+			case udpActionError:
+				return buf[:n], nil
+			}
+			return nil, errors.New("Unexpected reply from UDP tracker " + addr.String())
+		}
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return
+		}
+	}
+	return nil, errors.New("UDP tracker " + addr.String() + " did not answer.")
+}
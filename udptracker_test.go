@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testConnectionId = 0x0123456789abcdef
+
+// answerUDPTracker plays a BEP 15 tracker with one peer, 1.2.3.4:6881.
+func answerUDPTracker(req []byte) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	resp := make([]byte, 8)
+	copy(resp[4:], req[12:16])
+	fail := func(reason string) []byte {
+		binary.BigEndian.PutUint32(resp, udpActionError)
+		return append(resp, reason...)
+	}
+	switch {
+	case len(req) == 16 && binary.BigEndian.Uint64(req) == UDP_TRACKER_PROTOCOL_ID:
+		binary.BigEndian.PutUint32(resp, udpActionConnect)
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], testConnectionId)
+		return append(resp, id[:]...)
+	case len(req) != 98 || binary.BigEndian.Uint64(req) != testConnectionId:
+		return fail("bad request")
+	case string(req[16:19]) == "bad":
+		return fail("unregistered torrent")
+	case binary.BigEndian.Uint32(req[80:]) != 2 || binary.BigEndian.Uint64(req[64:]) != 3 ||
+		binary.BigEndian.Uint32(req[92:]) != 0xffffffff || binary.BigEndian.Uint16(req[96:]) != 6881:
+		return fail("wrong announce")
+	}
+	binary.BigEndian.PutUint32(resp, udpActionAnnounce)
+	// Interval 1800, 4 leechers, 5 seeders, one peer.
+	resp = append(resp, 0, 0, 0x07, 0x08, 0, 0, 0, 4, 0, 0, 0, 5)
+	return append(resp, 1, 2, 3, 4, 0x1a, 0xe1)
+}
+
+func udpAnnounceURL(host, infoHash string) string {
+	q := url.Values{}
+	q.Add("info_hash", infoHash)
+	q.Add("peer_id", "-TT0001-abcdefghijkl")
+	q.Add("port", "6881")
+	q.Add("uploaded", "1")
+	q.Add("downloaded", "2")
+	q.Add("left", "3")
+	q.Add("compact", "1")
+	q.Add("event", "started")
+	return "udp://" + host + "/announce?" + q.Encode()
+}
+
+func checkUDPAnnounce(t *testing.T, host string) {
+	tr, err := getTrackerInfo(udpAnnounceURL(host, "abcdefghijabcdefghij"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.FailureReason != "" || tr.Interval != 1800 || tr.Incomplete != 4 || tr.Complete != 5 ||
+		tr.Peers != "\x01\x02\x03\x04\x1a\xe1" {
+		t.Errorf("Got %+v", tr)
+	}
+	tr, err = getTrackerInfo(udpAnnounceURL(host, "badefghijabcdefghijk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.FailureReason != "unregistered torrent" {
+		t.Errorf("Wanted a failure reason, got %+v", tr)
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answerUDPTracker(buf[:n]), from)
+		}
+	}()
+	checkUDPAnnounce(t, pc.LocalAddr().String())
+}
+
+// Through a SOCKS5 proxy the announce goes to the UDP associate relay, and
+// the proxy resolves the tracker's name.
+func TestUDPTrackerAnnounceThroughProxy(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	go func() {
+		// The relay answers for tracker.example:6969 itself.
+		buf := make([]byte, 2048)
+		for {
+			n, client, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r := bytes.NewReader(buf[4:n])
+			if addr, err := readSocks5Addr(r, buf[3]); err != nil || addr != "tracker.example:6969" {
+				continue
+			}
+			resp := []byte{0, 0, 0, socks5AddrIPv4, 10, 0, 0, 2, 0x1b, 0x39}
+			relay.WriteTo(append(resp, answerUDPTracker(buf[n-r.Len():n])...), client)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:3])
+				conn.Write([]byte{5, 0})
+				io.ReadFull(conn, buf[:4+4+2])
+				if buf[1] != socks5UDPAssociate {
+					conn.Write([]byte{5, 7, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				port := relay.LocalAddr().(*net.UDPAddr).Port
+				conn.Write([]byte{5, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+				// The relay lasts as long as this connection.
+				conn.Read(buf)
+			}()
+		}
+	}()
+
+	oldProxy := proxy
+	proxy, err = parseProxyURL("socks5://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { proxy = oldProxy }()
+	checkUDPAnnounce(t, "tracker.example:6969")
+}
+
+// A proxy that can't carry UDP refuses under -proxyStrict before we look up
+// the tracker's name ourselves.
+func TestUDPTrackerStrictProxyDoesNotResolve(t *testing.T) {
+	oldProxy, oldStrict := proxy, proxyStrict
+	defer func() { proxy, proxyStrict = oldProxy, oldStrict }()
+	var err error
+	if proxy, err = parseProxyURL("http://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	proxyStrict = true
+	_, err = getUDPTrackerInfo(udpAnnounceURL("tracker.invalid:6969", "abcdefghijabcdefghij"))
+	if err == nil || !strings.Contains(err.Error(), "can't carry UDP") {
+		t.Errorf("Wanted the proxy to refuse, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+)
+
+// Blocks requested by peers are read from disk by a pool of goroutines, so a
+// slow disk stalls the peers waiting for it rather than the main loop.
+const NUM_DISK_READERS = 4
+
+type diskRead struct {
+	peer                 *peerState
+	index, begin, length uint32
+	msg                  []byte // The complete PIECE message, once read
+	err                  error
+}
+
+func (t *TorrentSession) startDiskReaders() {
+	// Room for every request every peer can have queued, so handing out work
+	// hardly ever has to wait for a free slot.
+	t.diskReads = make(chan *diskRead, MAX_NUM_PEERS*MAX_PEER_REQUESTS)
+	t.diskReadsDone = make(chan *diskRead)
+	for i := 0; i < NUM_DISK_READERS; i++ {
+		go t.diskReader()
+	}
+}
+
+func (t *TorrentSession) diskReader() {
+	for r := range t.diskReads {
+		r.msg = make([]byte, r.length+9)
+		r.msg[0] = PIECE
+		uint32ToBytes(r.msg[1:5], r.index)
+		uint32ToBytes(r.msg[5:9], r.begin)
+		start := time.Now()
+		_, r.err = t.fileStore.ReadAt(r.msg[9:],
+			int64(r.index)*t.m.Info.PieceLength+int64(r.begin))
+		t.metrics.observe(&t.metrics.diskReadLatency, time.Now().Sub(start))
+		select {
+		case t.diskReadsDone <- r:
+		case <-t.ctx.Done():
+		}
+	}
+}
+
+// queueRequest records a block the peer asked for and starts reading it.
+func (t *TorrentSession) queueRequest(p *peerState, index, begin, length uint32) {
+	if !p.AddRequest(index, begin, length) {
+		// Choked peers and peers that ask for too much don't get anything.
+		return
+	}
+	if !t.startDiskReads(p) {
+		t.diskReadBacklog = true
+	}
+}
+
+// startDiskReads hands the peer's queued requests to the disk readers.
+// Returns false if the readers were too busy to take all of them.
+func (t *TorrentSession) startDiskReads(p *peerState) bool {
+	for k, reading := range p.peer_requests {
+		if reading {
+			continue
+		}
+		r := &diskRead{peer: p, index: uint32(k >> 32), begin: uint32(k), length: STANDARD_BLOCK_LENGTH}
+		select {
+		case t.diskReads <- r:
+			p.peer_requests[k] = true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sendRequest sends a block that has been read from disk, unless the peer
+// went away, cancelled the request or got choked while we were reading.
+func (t *TorrentSession) sendRequest(r *diskRead) (err error) {
+	peer := r.peer
+	if t.peers[peer.address] != peer {
+		return
+	}
+	if r.err != nil {
+		t.logger(storageLog).Error("Could not read block", "piece", r.index, "begin", r.begin, "peer", peer.address,
+			"err", r.err)
+		return r.err
+	}
+	if !peer.RemoveRequest(r.index, r.begin) || peer.am_choking {
+		return
+	}
+	peer.log.Debug("Sending block", "piece", r.index, "begin", r.begin)
+	peer.sendMessage(r.msg)
+	t.metrics.count(&t.metrics.blocksSent, 1)
+	t.si.Uploaded += int64(r.length)
+	peer.bytesSent += int64(r.length)
+	t.seeding.lastUpload = time.Now()
+	return
+}
+
+// restartDiskReads gives requests that found the disk readers busy another
+// chance, once a read has finished.
+func (t *TorrentSession) restartDiskReads() {
+	if !t.diskReadBacklog {
+		return
+	}
+	t.diskReadBacklog = false
+	for _, p := range t.peers {
+		if !t.startDiskReads(p) {
+			t.diskReadBacklog = true
+			return
+		}
+	}
+}
@@ -213,7 +213,7 @@ func soapRequest(url, function, message string) (r *http.Response, err error) {
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Pragma", "no-cache")
 
-	// log.Stderr("soapRequest ", req)
+	upnpLog.Debug("SOAP request", "url", url, "function", function)
 
 	r, err = http.DefaultClient.Do(req)
 	if r.Body != nil {
@@ -221,7 +221,7 @@ func soapRequest(url, function, message string) (r *http.Response, err error) {
 	}
 
 	if r.StatusCode >= 400 {
-		// log.Stderr(function, r.StatusCode)
+		upnpLog.Debug("SOAP request failed", "function", function, "status", r.StatusCode)
 		err = errors.New("Error " + strconv.Itoa(r.StatusCode) + " for " + function)
 		r = nil
 		return
@@ -265,7 +265,7 @@ func (n *upnpNAT) AddPortMapping(protocol string, externalPort, internalPort int
 	}
 
 	// TODO: check response to see if the port was forwarded
-	// log.Println(message, response)
+	upnpLog.Debug("Added port mapping", "protocol", protocol, "port", externalPort, "status", response.Status)
 	_ = response
 	return
 }
@@ -284,7 +284,7 @@ func (n *upnpNAT) DeletePortMapping(protocol string, externalPort int) (err erro
 	}
 
 	// TODO: check response to see if the port was deleted
-	// log.Println(message, response)
+	upnpLog.Debug("Deleted port mapping", "protocol", protocol, "port", externalPort, "status", response.Status)
 	_ = response
 	return
 }
@@ -0,0 +1,210 @@
+package main
+
+// The verify command rechecks a torrent's data against its hashes and
+// reports, file by file, what is complete and what is corrupt.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var verifyResume bool
+
+func init() {
+	flag.BoolVar(&verifyResume, "verifyResume", false, "With verify, save the pieces that passed the check as "+
+		"resume data, so the next session doesn't check them again.")
+}
+
+type FileReport struct {
+	Path      string // Relative to the torrent's directory
+	Length    int64
+	GoodBytes int64 // Bytes in pieces that passed the hash check
+	// "good" or "bad" if the torrent has an md5sum for this file, else "".
+	Md5sum string
+}
+
+func (f *FileReport) Complete() bool {
+	return f.GoodBytes == f.Length && f.Md5sum != "bad"
+}
+
+// A run of bytes, within one file, whose pieces failed the hash check.
+type CorruptRange struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+type VerifyReport struct {
+	Pieces     int
+	GoodPieces int
+	Bitfield   *Bitset // The pieces that passed
+	Files      []FileReport
+	Corrupt    []CorruptRange
+}
+
+func (r *VerifyReport) OK() bool {
+	for i, _ := range r.Files {
+		if !r.Files[i].Complete() {
+			return false
+		}
+	}
+	return r.GoodPieces == r.Pieces
+}
+
+// VerifyTorrent rechecks the data of a torrent where a session would store
+// it. newStore chooses where the data is kept; nil means the files, opened
+// read only, so that nothing is created or changed. With resume, the pieces
+// that passed are saved as resume data, with the files as they were checked.
+func VerifyTorrent(torrent string, newStore StorageFactory, resume bool) (report *VerifyReport, err error) {
+	m, err := getMetaInfo(torrent)
+	if err != nil {
+		return
+	}
+	dir, err := torrentStoreDir(&m.Info)
+	if err != nil {
+		return
+	}
+	if newStore == nil {
+		newStore = func(info *InfoDict, storePath string) (FileStore, int64, error) {
+			return NewFileStoreWithOptions(info, storePath, FileStoreOptions{ReadOnly: true})
+		}
+	}
+	fs, totalSize, err := newStore(&m.Info, dir)
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+	if report, err = Verify(m, fs, totalSize); err != nil || !resume {
+		return
+	}
+	err = writeResumeData(m, fs, report.Bitfield)
+	return
+}
+
+// Verify checks the data in fs against the hashes in m, and against the
+// md5sums of any files that have one.
+func Verify(m *MetaInfo, fs FileStore, totalSize int64) (report *VerifyReport, err error) {
+	good, bad, goodBits, err := checkPieces(fs, totalSize, m)
+	if err != nil {
+		return
+	}
+	paths, err := torrentFilePaths(&m.Info)
+	if err != nil {
+		return
+	}
+	report = &VerifyReport{Pieces: good + bad, GoodPieces: good, Bitfield: goodBits}
+	pieceLength := m.Info.PieceLength
+	var start int64
+	for i, f := range torrentFiles(&m.Info) {
+		fr := FileReport{Path: paths[i], Length: f.Length}
+		end := start + f.Length
+		for piece := start / pieceLength; piece*pieceLength < end; piece++ {
+			// The part of this piece that is in this file.
+			from, to := piece*pieceLength, (piece+1)*pieceLength
+			if from < start {
+				from = start
+			}
+			if to > end {
+				to = end
+			}
+			if goodBits.IsSet(int(piece)) {
+				fr.GoodBytes += to - from
+				continue
+			}
+			last := len(report.Corrupt) - 1
+			if last >= 0 && report.Corrupt[last].Path == fr.Path &&
+				report.Corrupt[last].Offset+report.Corrupt[last].Length == from-start {
+				report.Corrupt[last].Length += to - from
+			} else {
+				report.Corrupt = append(report.Corrupt, CorruptRange{fr.Path, from - start, to - from})
+			}
+		}
+		if f.Md5sum != "" {
+			fr.Md5sum = "bad"
+			if checkMd5sum(fs, start, f.Length, f.Md5sum) {
+				fr.Md5sum = "good"
+			}
+		}
+		report.Files = append(report.Files, fr)
+		start = end
+	}
+	return
+}
+
+// checkMd5sum compares the md5 of length bytes at off in fs with sum, which
+// is in hex.
+func checkMd5sum(fs FileStore, off, length int64, sum string) bool {
+	hasher := md5.New()
+	buf := make([]byte, 1024*1024)
+	for length > 0 {
+		chunk := buf
+		if int64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+		// Short files read as zeros, and then fail the check.
+		fs.ReadAt(chunk, off)
+		hasher.Write(chunk)
+		off += int64(len(chunk))
+		length -= int64(len(chunk))
+	}
+	return strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), sum)
+}
+
+func (r *VerifyReport) Print() {
+	fmt.Printf("%d of %d pieces good\n", r.GoodPieces, r.Pieces)
+	for _, f := range r.Files {
+		percent := 100.0
+		if f.Length > 0 {
+			percent = 100 * float64(f.GoodBytes) / float64(f.Length)
+		}
+		sum := ""
+		if f.Md5sum != "" {
+			sum = " md5 " + f.Md5sum
+		}
+		fmt.Printf("%6.2f%%%s %s\n", percent, sum, f.Path)
+	}
+	for _, c := range r.Corrupt {
+		fmt.Printf("bad bytes %d-%d of %s\n", c.Offset, c.Offset+c.Length-1, c.Path)
+	}
+}
+
+// verifyMain runs "Taipei-Torrent verify torrent". It exits with status 1 if
+// anything is missing or corrupt.
+func verifyMain(args []string) {
+	if len(args) != 1 {
+		log.Println("verify needs exactly one torrent file or torrent URL.")
+		usage()
+	}
+	if err := setLogLevels(logLevelSpec); err != nil {
+		log.Println("Bad -logLevel:", err)
+		os.Exit(2)
+	}
+	if err := initProxy(); err != nil {
+		sessionLog.Error("Bad proxy configuration", "err", err)
+		os.Exit(2)
+	}
+	var newStore StorageFactory
+	if storageFlag != "file" {
+		var err error
+		if newStore, err = storageFromFlags(); err != nil {
+			storageLog.Error("Bad storage configuration", "err", err)
+			os.Exit(2)
+		}
+	}
+	report, err := VerifyTorrent(args[0], newStore, verifyResume)
+	if report != nil {
+		report.Print()
+	}
+	if err != nil {
+		storageLog.Error("Could not verify torrent", "torrent", args[0], "err", err)
+		os.Exit(2)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
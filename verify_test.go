@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	// Two files over three 8 byte pieces; the middle piece straddles them.
+	data := []byte("aaaaaaaabbbbbbbbcccc")
+	m := &MetaInfo{Info: InfoDict{
+		PieceLength: 8,
+		Name:        "test",
+		Files: []FileDict{
+			{Length: 12, Path: []string{"one"}},
+			{Length: 8, Path: []string{"two"}},
+		},
+	}}
+	for i := 0; i < len(data); i += 8 {
+		end := i + 8
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[i:end])
+		m.Info.Pieces += string(sum[:])
+	}
+	sum := md5.Sum(data[12:])
+	m.Info.Files[1].Md5sum = hex.EncodeToString(sum[:])
+
+	fs, totalSize, err := NewMemFileStore(&m.Info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.WriteAt(data, 0)
+	fs.WriteAt([]byte("x"), 9)
+	r, err := Verify(m, fs, totalSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pieces != 3 || r.GoodPieces != 2 || r.Bitfield.IsSet(1) {
+		t.Errorf("Wanted pieces 0 and 2 of 3 good, got %d of %d", r.GoodPieces, r.Pieces)
+	}
+	if f := r.Files[0]; f.GoodBytes != 8 || f.Md5sum != "" || f.Complete() {
+		t.Errorf("File one: %+v", f)
+	}
+	if f := r.Files[1]; f.GoodBytes != 4 || f.Md5sum != "good" {
+		t.Errorf("File two: %+v", f)
+	}
+	want := []CorruptRange{{"one", 8, 4}, {"two", 0, 4}}
+	if len(r.Corrupt) != len(want) || r.Corrupt[0] != want[0] || r.Corrupt[1] != want[1] {
+		t.Errorf("Wanted corrupt ranges %v, got %v", want, r.Corrupt)
+	}
+	if r.OK() {
+		t.Errorf("Report should not be OK")
+	}
+
+	fs.WriteAt([]byte("b"), 9)
+	fs.WriteAt([]byte("C"), 19)
+	if r, err = Verify(m, fs, totalSize); err != nil {
+		t.Fatal(err)
+	}
+	if f := r.Files[1]; f.Md5sum != "bad" || f.Complete() {
+		t.Errorf("File two should fail its md5sum: %+v", f)
+	}
+}
+
+func TestReadOnlyFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _, err := NewFileStoreWithOptions(&storageTestInfo, dir, FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	p := []byte("xxxx")
+	if _, err = fs.ReadAt(p, 0); err != nil || string(p) != "\x00\x00\x00\x00" {
+		t.Errorf("Missing file should read as zeros, got %q, %v", p, err)
+	}
+	if _, err = fs.WriteAt(p, 0); err == nil {
+		t.Errorf("Write to a read only store should fail")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("Read only store created a file: %v", err)
+	}
+}
+
+func TestVerifyWritesResumeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFileDir := fileDir
+	fileDir = dir
+	defer func() { fileDir = oldFileDir }()
+	m := &MetaInfo{InfoHash: "01234567890123456789", Info: storageTestInfo}
+
+	fs, _, err := NewFileStoreWithOptions(&m.Info, dir, FileStoreOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = writeResumeData(m, fs, NewBitset(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(resumePath(m)); err != nil {
+		t.Errorf("No resume data: %v", err)
+	}
+
+	mem, _, _ := NewMemFileStore(&m.Info, "")
+	if err = writeResumeData(m, mem, NewBitset(2)); err == nil {
+		t.Errorf("Wrote resume data for a store without file stamps")
+	}
+}
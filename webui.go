@@ -0,0 +1,324 @@
+package main
+
+// A small web UI, served at / next to the API. It lists the sessions and
+// shows the peers, pieces, tracker and files of the one picked. It keeps
+// up to date through /api/events, a stream of server-sent events, and
+// changes things through the JSON API.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// How often /api/events sends an update.
+const EVENT_INTERVAL = 1 * time.Second
+
+type sessionDetail struct {
+	InfoHash string        `json:"infoHash"`
+	Peers    []PeerStatus  `json:"peers"`
+	Pieces   PieceStatus   `json:"pieces"`
+	Tracker  TrackerStatus `json:"tracker"`
+	Files    []FileStatus  `json:"files"`
+}
+
+type eventData struct {
+	Torrents []SessionStatus `json:"torrents"`
+	Detail   *sessionDetail  `json:"detail,omitempty"` // Of the torrent parameter, if any
+}
+
+func (a *apiServer) snapshot(hash string) (e eventData) {
+	e.Torrents = []SessionStatus{}
+	for _, s := range a.sessions.List() {
+		e.Torrents = append(e.Torrents, s.status())
+	}
+	if s := a.sessions.Get(hash); s != nil {
+		ts := s.ts
+		d := &sessionDetail{}
+		s.inspect(func() {
+			d.InfoHash = fmt.Sprintf("%x", ts.m.InfoHash)
+			d.Peers = ts.peerStatus()
+			d.Pieces = ts.pieceStatus()
+			d.Tracker = ts.trackerStatus()
+			d.Files = ts.fileStatus()
+		})
+		e.Detail = d
+	}
+	return
+}
+
+// events streams a snapshot each EVENT_INTERVAL until the client goes away.
+func (a *apiServer) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Streaming not supported."})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	hash := r.URL.Query().Get("torrent")
+	tick := time.NewTicker(EVENT_INTERVAL)
+	defer tick.Stop()
+	for {
+		b, err := json.Marshal(a.snapshot(hash))
+		if err != nil {
+			apiLog.Error("Could not encode event", "err", err)
+			return
+		}
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-tick.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func serveWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// The page holds no data. It asks for the token, and the API checks it.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, webUIPage)
+}
+
+const webUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Taipei-Torrent</title>
+<style>
+body { font: 13px sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+th, td { text-align: left; padding: 2px 8px; border-bottom: 1px solid #ddd; }
+tr.torrent { cursor: pointer; }
+tr.selected { background: #e8f0fe; }
+.bar { width: 120px; height: 10px; background: #eee; display: inline-block; }
+.bar div { height: 10px; background: #4a4; }
+#pieces { border: 1px solid #ccc; }
+h2 { font-size: 15px; margin: 1em 0 .3em; }
+#status { color: #a00; }
+</style>
+</head>
+<body>
+<h1>Taipei-Torrent</h1>
+<form id="add">
+<input id="uri" size="60" placeholder="Torrent URL, magnet link or path">
+<button>Add</button>
+<span id="status"></span>
+</form>
+<table>
+<thead><tr><th>Name</th><th>State</th><th>Progress</th><th>Down</th><th>Up</th><th>ETA</th>
+<th>Peers</th><th>Ratio</th><th></th></tr></thead>
+<tbody id="torrents"></tbody>
+</table>
+<div id="detail" hidden>
+<h2>Pieces</h2>
+<canvas id="pieces" width="800" height="40"></canvas>
+<div>Have (green), downloading (orange), missing (grey).</div>
+<h2>Tracker</h2>
+<div id="tracker"></div>
+<h2>Peers</h2>
+<table>
+<thead><tr><th>Address</th><th>Client</th><th>Has</th><th>Down</th><th>We choke</th><th>We are interested</th>
+<th>Chokes us</th><th>Is interested</th><th>Requests</th></tr></thead>
+<tbody id="peers"></tbody>
+</table>
+<div>Connections are never encrypted.</div>
+<h2>Files</h2>
+<table>
+<thead><tr><th>Download</th><th>Path</th><th>Size</th></tr></thead>
+<tbody id="files"></tbody>
+</table>
+</div>
+<script>
+var token = localStorage.getItem("token") || "";
+var selected = "";
+var events = null;
+
+function call(method, path, body) {
+	var opts = {method: method, headers: {"Authorization": "Bearer " + token}};
+	if (body !== undefined) {
+		opts.headers["Content-Type"] = "application/json";
+		opts.body = JSON.stringify(body);
+	}
+	return fetch(path, opts).then(function(r) {
+		return r.json().then(function(v) {
+			if (v.error) {
+				throw new Error(v.error);
+			}
+			return v;
+		});
+	}).catch(function(e) {
+		document.getElementById("status").textContent = e.message;
+	});
+}
+
+function listen() {
+	if (events) {
+		events.close();
+	}
+	var url = "/api/events?token=" + encodeURIComponent(token) +
+		"&torrent=" + encodeURIComponent(selected);
+	events = new EventSource(url);
+	events.onmessage = function(e) { show(JSON.parse(e.data)); };
+	events.onerror = function() {
+		events.close();
+		fetch("/api/torrents", {headers: {"Authorization": "Bearer " + token}}).then(function(r) {
+			if (r.status == 401) {
+				token = prompt("API token") || "";
+				localStorage.setItem("token", token);
+			}
+			setTimeout(listen, 2000);
+		});
+	};
+}
+
+function size(n) {
+	var units = ["B", "kB", "MB", "GB", "TB"];
+	var i = 0;
+	while (n >= 1000 && i < units.length - 1) {
+		n /= 1000;
+		i++;
+	}
+	return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function duration(s) {
+	if (s < 0) {
+		return "";
+	}
+	var h = Math.floor(s / 3600), m = Math.floor(s / 60) % 60;
+	return h ? h + "h " + m + "m" : m + "m " + (s % 60) + "s";
+}
+
+function cell(tr, content) {
+	var td = tr.insertCell();
+	if (content instanceof Node) {
+		td.appendChild(content);
+	} else {
+		td.textContent = content;
+	}
+	return td;
+}
+
+function button(label, onclick) {
+	var b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = function(e) { e.stopPropagation(); onclick(); };
+	return b;
+}
+
+function show(data) {
+	var tbody = document.getElementById("torrents");
+	tbody.innerHTML = "";
+	data.torrents.forEach(function(t) {
+		var tr = tbody.insertRow();
+		tr.className = "torrent" + (t.infoHash == selected ? " selected" : "");
+		tr.onclick = function() { selected = t.infoHash; listen(); };
+		cell(tr, t.name);
+		cell(tr, t.state + (t.error ? ": " + t.error : ""));
+		var bar = document.createElement("span");
+		bar.className = "bar";
+		bar.innerHTML = "<div></div>";
+		var done = t.pieces ? t.goodPieces / t.pieces : 1;
+		bar.firstChild.style.width = (100 * done).toFixed(1) + "%";
+		var progress = cell(tr, bar);
+		progress.appendChild(document.createTextNode(" " + (100 * done).toFixed(1) + "%"));
+		cell(tr, size(t.downloadRate) + "/s");
+		cell(tr, size(t.uploadRate) + "/s");
+		cell(tr, duration(t.eta));
+		cell(tr, t.peers);
+		cell(tr, t.ratio.toFixed(2));
+		var actions = cell(tr, "");
+		var path = "/api/torrents/" + t.infoHash;
+		if (t.state == "paused") {
+			actions.appendChild(button("Resume", function() { call("POST", path + "/resume"); }));
+		} else if (t.state != "stopped") {
+			actions.appendChild(button("Pause", function() { call("POST", path + "/pause"); }));
+		}
+		actions.appendChild(button("Remove", function() {
+			if (confirm("Remove " + t.name + "? The data stays.")) {
+				call("DELETE", path);
+			}
+		}));
+	});
+	var detail = data.detail;
+	document.getElementById("detail").hidden = !detail;
+	if (detail) {
+		showDetail(detail);
+	}
+}
+
+function showDetail(d) {
+	var canvas = document.getElementById("pieces");
+	var ctx = canvas.getContext("2d");
+	var bits = atob(d.pieces.bitfield || "");
+	var active = {};
+	d.pieces.active.forEach(function(i) { active[i] = true; });
+	var w = canvas.width / Math.max(d.pieces.pieces, 1);
+	for (var i = 0; i < d.pieces.pieces; i++) {
+		var have = bits.charCodeAt(i >> 3) & (0x80 >> (i & 7));
+		ctx.fillStyle = have ? "#4a4" : active[i] ? "#f90" : "#ddd";
+		ctx.fillRect(Math.floor(i * w), 0, Math.ceil(w), canvas.height);
+	}
+
+	var t = d.tracker;
+	document.getElementById("tracker").textContent = (t.announce || "No tracker") +
+		(t.lastAnnounce && t.lastAnnounce[0] != "0" ? ", last announce " + new Date(t.lastAnnounce).toLocaleString() : "") +
+		(t.lastError ? ", error: " + t.lastError : "") +
+		", " + t.seeders + " seeders, " + t.leechers + " leechers";
+
+	var peers = document.getElementById("peers");
+	peers.innerHTML = "";
+	d.peers.forEach(function(p) {
+		var tr = peers.insertRow();
+		cell(tr, p.address);
+		cell(tr, p.client);
+		cell(tr, (100 * p.pieces / Math.max(d.pieces.pieces, 1)).toFixed(0) + "%");
+		cell(tr, size(p.downloadRate) + "/s");
+		[p.choking, p.interested, p.peerChoking, p.peerInterested].forEach(function(flag) {
+			cell(tr, flag ? "yes" : "");
+		});
+		cell(tr, p.requests + " / " + p.peerRequests);
+	});
+
+	var files = document.getElementById("files");
+	files.innerHTML = "";
+	d.files.forEach(function(f) {
+		var tr = files.insertRow();
+		var box = document.createElement("input");
+		box.type = "checkbox";
+		box.checked = f.priority != 0;
+		box.onchange = function() {
+			call("PUT", "/api/torrents/" + d.infoHash + "/files/" + f.index, {priority: box.checked ? 1 : 0});
+		};
+		cell(tr, box);
+		cell(tr, f.path);
+		cell(tr, size(f.length));
+	});
+}
+
+document.getElementById("add").onsubmit = function(e) {
+	e.preventDefault();
+	var uri = document.getElementById("uri");
+	call("POST", "/api/torrents", {uri: uri.value}).then(function(v) {
+		if (v) {
+			uri.value = "";
+			document.getElementById("status").textContent = "";
+		}
+	});
+};
+
+listen();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	sessions := newSessionManager(nil)
+	sessions.run = serveControl
+	ts := newControlledSession()
+	ts.pieceSet.Set(2)
+	if _, err := sessions.start(ts); err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.Wait()
+	defer sessions.StopAll()
+	server := httptest.NewServer(&apiServer{sessions, "secret"})
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/events?token=secret&torrent=3031323334353637383930313233343536373839")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content type %s", ct)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("Read %q, %v", line, err)
+	}
+	var e eventData
+	if err = json.Unmarshal([]byte(line[6:]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Torrents) != 1 || e.Detail == nil || e.Detail.Pieces.Bitfield[0] != 0x20 || len(e.Detail.Files) != 1 {
+		t.Errorf("Event %+v", e)
+	}
+}
+
+func TestWebUIPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveWebUI(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/api/events") {
+		t.Errorf("Got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	serveWebUI(w, httptest.NewRequest("GET", "/nothing", nil))
+	if w.Code != 404 {
+		t.Errorf("Got %d for a missing page", w.Code)
+	}
+}